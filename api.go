@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"time"
+)
+
+// apiTimeLayouts are the timestamp layouts accepted in API responses besides
+// unix seconds; layouts without a zone are read as UTC
+var apiTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+// APISource fetches a forecast from a weather API returning JSON and
+// computes the window values in Go. The timestamps and precipitation values
+// are read from two parallel arrays located by API.TimePath and
+// API.ValuePath, e.g. hourly.time and hourly.precipitation.
+type APISource struct {
+	pointSource
+}
+
+// NewAPISource creates a source backed by the configured weather API.
+func NewAPISource(config *Configuration) *APISource {
+	return &APISource{pointSource{
+		config:    config,
+		now:       time.Now,
+		origin:    config.API.URL,
+		aggregate: config.API.Aggregation,
+		load: func(time.Time, time.Time) ([]precipPoint, error) {
+			return fetchAPI(config)
+		},
+	}}
+}
+
+// fetchAPI requests the forecast and extracts its points.
+func fetchAPI(config *Configuration) ([]precipPoint, error) {
+	var doc interface{}
+	if err := getJSON(config.API.URL, config.API.Headers, config.API.Timeout, &doc); err != nil {
+		return nil, err
+	}
+	return extractAPIPoints(doc, config.API.TimePath, config.API.ValuePath)
+}
+
+// getJSON requests a weather API and decodes its JSON response into out.
+func getJSON(url string, headers map[string]string, timeout time.Duration, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("unable to build weather API request, %s", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL may carry an API key, so only the cause is reported
+		var urlErr *neturl.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("weather API request failed, %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading weather API response, %s", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("weather API returned status %s", resp.Status)
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("unable to decode weather API response, %s", err)
+	}
+	return nil
+}
+
+// extractAPIPoints pairs the timestamps and values found at the given paths.
+// Null values, which some APIs use for hours without a forecast, are skipped.
+func extractAPIPoints(doc interface{}, timePath string, valuePath string) ([]precipPoint, error) {
+	times, err := jsonArray(doc, timePath)
+	if err != nil {
+		return nil, err
+	}
+	values, err := jsonArray(doc, valuePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(times) != len(values) {
+		return nil, fmt.Errorf("weather API returned %d timestamps at %s but %d values at %s",
+			len(times), timePath, len(values), valuePath)
+	}
+
+	points := make([]precipPoint, 0, len(values))
+	for i := range values {
+		if values[i] == nil {
+			continue
+		}
+		value, ok := values[i].(float64)
+		if !ok {
+			return nil, fmt.Errorf("weather API value %v at %s[%d] is not numeric", values[i], valuePath, i)
+		}
+		timestamp, err := parseAPITime(times[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp at %s[%d], %s", timePath, i, err)
+		}
+		points = append(points, precipPoint{time: timestamp, value: value})
+	}
+	return points, nil
+}
+
+// jsonArray returns the array found at a dot-separated path.
+func jsonArray(doc interface{}, path string) ([]interface{}, error) {
+	value, ok := lookupJSONPath(doc, path)
+	if !ok {
+		return nil, fmt.Errorf("weather API response is missing field %s", path)
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("weather API field %s is not an array", path)
+	}
+	return array, nil
+}
+
+// parseAPITime reads a timestamp given as unix seconds or in one of
+// apiTimeLayouts.
+func parseAPITime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case float64:
+		return time.Unix(int64(v), 0), nil
+	case string:
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(seconds, 0), nil
+		}
+		for _, layout := range apiTimeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("unrecognized time %s", v)
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %v", value)
+}
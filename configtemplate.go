@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// configTemplateData is the data available to templated config files
+type configTemplateData struct {
+	Env map[string]string
+}
+
+// RenderConfigTemplate renders a config file as a Go template. The template
+// uses [[ and ]] as delimiters so that the {{.ID}} placeholders of webhook
+// URLs pass through untouched. Environment variables are available as
+// [[.Env.NAME]], or via [[env "NAME"]] which yields an empty string for unset
+// variables.
+func RenderConfigTemplate(path string) (io.Reader, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file, %s", err)
+	}
+
+	tmpl, err := template.New(path).Delims("[[", "]]").Funcs(template.FuncMap{"env": os.Getenv}).Parse(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config template, %s", err)
+	}
+
+	data := configTemplateData{Env: make(map[string]string)}
+	for _, entry := range os.Environ() {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			data.Env[key] = value
+		}
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, fmt.Errorf("unable to render config template, %s", err)
+	}
+	return &rendered, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"slices"
+)
+
+// Policies supported by Schedule.ConflictPolicy for a device both the start
+// and the stop would act on in the same evaluation
+const (
+	ConflictSafest      = "safest"
+	ConflictPreferStart = "prefer-start"
+	ConflictPreferStop  = "prefer-stop"
+)
+
+// conflictWinner returns the action the policy lets act on a conflict, or
+// nothing when neither may: the safest policy leaves the vacuum as it is.
+func conflictWinner(policy string) string {
+	switch policy {
+	case ConflictPreferStart:
+		return "start"
+	case ConflictPreferStop:
+		return "stop"
+	}
+	return ""
+}
+
+// ApplyConflict vetoes the action when the start and the stop would both act
+// on the device in the same evaluation and the conflict policy does not let
+// this action win.
+func ApplyConflict(policy string, action string, conflicted bool, decision Decision) Decision {
+	if !decision.Act || !conflicted || conflictWinner(policy) == action {
+		return decision
+	}
+	if policy == "" {
+		policy = ConflictSafest
+	}
+	return Decision{Code: ReasonConflict, Reason: fmt.Sprintf("start and stop both apply, not taking %s action under the %s conflict policy",
+		action, policy)}
+}
+
+// FindConflicts decides the start and the stop for every device without
+// acting and returns the devices, by name, that both would act on. Nothing is
+// decided unless the actions include both. The stop grace period is not
+// waited for, so a stop it might call off still counts as acting. A device
+// failing to decide is not reported; its evaluation fails on its own.
+func FindConflicts(ctx context.Context, config *Configuration, cliInputs CliInputs, source Source, actions []string) map[string]bool {
+	if !slices.Contains(actions, "start") || !slices.Contains(actions, "stop") {
+		return nil
+	}
+
+	acting := make(map[string]int)
+	probe := *config
+	probe.decideOnly = true
+	probe.onSummary = func(summary RunSummary) {
+		if summary.Act {
+			acting[summary.Device]++
+		}
+	}
+	configs := []*Configuration{&probe}
+	if len(probe.Vacuums) > 0 {
+		configs = configs[:0]
+		for _, device := range probe.Vacuums {
+			configs = append(configs, probe.ForDevice(device))
+		}
+	}
+
+	inputs := cliInputs
+	inputs.Quiet = true
+	for _, action := range []string{"start", "stop"} {
+		inputs.Action = action
+		for _, decided := range configs {
+			logger := log.WithField("action", action)
+			if decided.device != "" {
+				logger = logger.WithField("device", decided.device)
+			}
+			if err := Run(ctx, decided, inputs, source, logger); err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "FindConflicts",
+					"error": err,
+				}).Debug("failed to decide action while looking for conflicts")
+			}
+		}
+	}
+
+	conflicted := make(map[string]bool)
+	for device, count := range acting {
+		if count < 2 {
+			continue
+		}
+		conflicted[device] = true
+		policy := config.Schedule.ConflictPolicy
+		if policy == "" {
+			policy = ConflictSafest
+		}
+		winner := conflictWinner(policy)
+		if winner == "" {
+			winner = "none"
+		}
+		fields := log.Fields{
+			"op":     "FindConflicts",
+			"policy": policy,
+			"acting": winner,
+		}
+		if device != "" {
+			fields["device"] = device
+		}
+		log.WithFields(fields).Warn("start and stop both apply, resolving conflict by policy")
+	}
+	return conflicted
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// correlationHeader carries the correlation ID on outbound requests
+const correlationHeader = "X-Correlation-ID"
+
+// correlationID identifies the current invocation, or the current
+// evaluation of the daemon, in logs and outbound requests so a run can be
+// traced across systems. It is guarded by correlationMu since the daemon
+// replaces it while its metrics server may be logging.
+var (
+	correlationID string
+	correlationMu sync.RWMutex
+)
+
+// correlationHook adds the correlation ID to every log entry
+type correlationHook struct{}
+
+// Levels applies the hook to every log level.
+func (h correlationHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire sets the correlation_id field on the entry.
+func (h correlationHook) Fire(entry *log.Entry) error {
+	entry.Data["correlation_id"] = CorrelationID()
+	return nil
+}
+
+// ConfigureCorrelationID sets the correlation ID of this invocation,
+// generating a random UUID when none is given, and adds it to every log line.
+func ConfigureCorrelationID(id string) {
+	SetCorrelationID(id)
+	log.AddHook(correlationHook{})
+}
+
+// SetCorrelationID replaces the correlation ID, generating a random UUID
+// when none is given. The daemon calls it for every evaluation.
+func SetCorrelationID(id string) {
+	if id == "" {
+		id = uuid.NewString()
+	}
+	correlationMu.Lock()
+	defer correlationMu.Unlock()
+	correlationID = id
+}
+
+// CorrelationID returns the current correlation ID.
+func CorrelationID() string {
+	correlationMu.RLock()
+	defer correlationMu.RUnlock()
+	return correlationID
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSVSource reads timestamped precipitation values from a local CSV file and
+// computes the window maxima in Go. Each row holds an RFC3339 timestamp and a
+// value; a header row is skipped if present.
+type CSVSource struct {
+	pointSource
+}
+
+// NewCSVSource creates a source backed by the configured CSV file. The
+// windows end at the time given with -as-of, or now.
+func NewCSVSource(config *Configuration) *CSVSource {
+	now := time.Now
+	if !config.asOf.IsZero() {
+		now = func() time.Time { return config.asOf }
+	}
+	return &CSVSource{pointSource{
+		config: config,
+		now:    now,
+		origin: config.CSV.Path,
+		load: func(time.Time, time.Time) ([]precipPoint, error) {
+			return loadCSV(config.CSV.Path)
+		},
+	}}
+}
+
+// loadCSV reads every point from the CSV file.
+func loadCSV(path string) ([]precipPoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening CSV file, %s", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	var points []precipPoint
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV file, %s", err)
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, strings.TrimSpace(record[0]))
+		if err != nil {
+			if line == 1 {
+				// header row
+				continue
+			}
+			return nil, fmt.Errorf("invalid timestamp on line %d, %s", line, err)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value on line %d, %s", line, err)
+		}
+		points = append(points, precipPoint{time: timestamp, value: value})
+	}
+	return points, nil
+}
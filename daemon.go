@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// EvaluateResponse is the JSON result of an on-demand evaluation: the summary
+// of the final run for each device and the error of the evaluation, if any
+type EvaluateResponse struct {
+	Action string       `json:"action"`
+	Runs   []RunSummary `json:"runs"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// evaluateRequest asks the daemon loop for an on-demand evaluation of the
+// action; the result is sent on response
+type evaluateRequest struct {
+	action   string
+	response chan EvaluateResponse
+}
+
+// RunDaemon evaluates the scheduled actions every Schedule.EvaluateEvery,
+// starting immediately, until SIGTERM or SIGINT is received. The source is
+// set up once and reused between evaluations, refreshing what it resolved
+// from the stored data at every tick; when it cannot be set up or refreshed
+// the evaluations are skipped and it is tried again at the next tick. A failed
+// evaluation is logged and does not stop the daemon. When the actions include
+// both the start and the stop, both are decided for every device before
+// either is taken, and a device both would act on is resolved by
+// Schedule.ConflictPolicy. When Schedule.MetricsAddress is set the outcome of
+// every run is served on /metrics, and POST /evaluate?action=start runs an evaluation immediately,
+// between the scheduled ones, and responds with its result as JSON.
+//
+// On SIGHUP the configuration is reloaded through reload and used from the
+// next tick, with the source set up again. A configuration that cannot be
+// loaded or is invalid is logged and the current one kept. The metrics
+// address, logging and HTTP settings are only read at startup.
+func RunDaemon(config *Configuration, cliInputs CliInputs, reload func() (*Configuration, error)) error {
+	if config.Schedule.EvaluateEvery <= 0 {
+		return fmt.Errorf("schedule.evaluateEvery must be set in daemon mode")
+	}
+	actions := daemonActions(config, cliInputs)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	evaluations := make(chan evaluateRequest)
+	if config.Schedule.MetricsAddress != "" {
+		config.metrics = NewMetrics()
+		if err := ServeMetrics(ctx, config.Schedule.MetricsAddress, config.metrics, evaluateHandler(ctx, evaluations)); err != nil {
+			return err
+		}
+	}
+
+	var source Source
+	defer func() {
+		if source != nil {
+			source.Close()
+		}
+	}()
+
+	// prepare starts an evaluation under an ID of its own and sets up the
+	// source, or refreshes what it resolved
+	prepare := func() error {
+		SetCorrelationID("")
+		if source == nil {
+			var err error
+			if source, err = NewSource(config); err != nil {
+				source = nil
+				log.WithFields(log.Fields{
+					"op":    "RunDaemon",
+					"error": err,
+				}).Error("failed to set up precipitation source")
+				return err
+			}
+		} else if refreshable, ok := source.(RefreshableSource); ok {
+			if err := refreshable.Refresh(ctx); err != nil {
+				log.WithFields(log.Fields{
+					"op":    "RunDaemon",
+					"error": err,
+				}).Error("failed to refresh precipitation source")
+				return err
+			}
+		}
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"op":            "RunDaemon",
+		"evaluateEvery": config.Schedule.EvaluateEvery,
+		"actions":       actions,
+	}).Info("started daemon")
+
+	ticker := time.NewTicker(config.Schedule.EvaluateEvery)
+	defer ticker.Stop()
+	for {
+		ready := prepare() == nil
+		evaluation := config
+		if ready {
+			// Devices both the start and the stop would act on only see the
+			// action the conflict policy lets win
+			if conflicted := FindConflicts(ctx, config, cliInputs, source, actions); len(conflicted) > 0 {
+				resolved := *config
+				resolved.conflicted = conflicted
+				evaluation = &resolved
+			}
+		}
+		for _, action := range actions {
+			if !ready || ctx.Err() != nil {
+				break
+			}
+			inputs := cliInputs
+			inputs.Action = action
+			if err := EvaluateDevices(ctx, evaluation, inputs, source); err != nil {
+				log.WithFields(log.Fields{
+					"op":     "RunDaemon",
+					"action": action,
+					"error":  err,
+				}).Error("evaluation failed")
+			}
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				log.WithFields(log.Fields{
+					"op": "RunDaemon",
+				}).Info("received signal, stopping daemon")
+				return nil
+			case <-hup:
+				reloaded, err := reload()
+				if err == nil && reloaded.Schedule.EvaluateEvery <= 0 {
+					err = fmt.Errorf("schedule.evaluateEvery must be set in daemon mode")
+				}
+				if err != nil {
+					log.WithFields(log.Fields{
+						"op":    "RunDaemon",
+						"error": err,
+					}).Error("failed to reload configuration, keeping the current one")
+					continue
+				}
+				reloaded.metrics = config.metrics
+				config = reloaded
+				actions = daemonActions(config, cliInputs)
+				ticker.Reset(config.Schedule.EvaluateEvery)
+				if source != nil {
+					source.Close()
+					source = nil
+				}
+				log.WithFields(log.Fields{
+					"op":            "RunDaemon",
+					"evaluateEvery": config.Schedule.EvaluateEvery,
+					"actions":       actions,
+				}).Info("reloaded configuration")
+			case request := <-evaluations:
+				response := EvaluateResponse{Action: request.action, Runs: []RunSummary{}}
+				if err := prepare(); err != nil {
+					response.Error = err.Error()
+					request.response <- response
+					continue
+				}
+				// Runs are recorded per device, the retried attempts of a
+				// device replacing its earlier ones
+				evaluation := *config
+				evaluation.onSummary = func(summary RunSummary) {
+					if last := len(response.Runs) - 1; last >= 0 && response.Runs[last].Device == summary.Device {
+						response.Runs[last] = summary
+						return
+					}
+					response.Runs = append(response.Runs, summary)
+				}
+				inputs := cliInputs
+				inputs.Action = request.action
+				log.WithFields(log.Fields{
+					"op":     "RunDaemon",
+					"action": request.action,
+				}).Info("evaluating on demand")
+				if err := EvaluateDevices(ctx, &evaluation, inputs, source); err != nil {
+					response.Error = err.Error()
+				}
+				request.response <- response
+			case <-ticker.C:
+				waiting = false
+			}
+		}
+	}
+}
+
+// daemonActions returns the actions evaluated at every tick.
+func daemonActions(config *Configuration, cliInputs CliInputs) []string {
+	if len(config.Schedule.Actions) == 0 {
+		return []string{cliInputs.Action}
+	}
+	return config.Schedule.Actions
+}
+
+// evaluateHandler passes POST /evaluate?action=start or stop requests on to
+// the daemon loop and writes the result as JSON, with status 500 when the
+// evaluation failed.
+func evaluateHandler(ctx context.Context, evaluations chan<- evaluateRequest) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		action := r.URL.Query().Get("action")
+		if action != "start" && action != "stop" {
+			http.Error(w, "action must be either start or stop", http.StatusBadRequest)
+			return
+		}
+
+		request := evaluateRequest{action: action, response: make(chan EvaluateResponse, 1)}
+		select {
+		case evaluations <- request:
+		case <-ctx.Done():
+			http.Error(w, "daemon is stopping", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		var response EvaluateResponse
+		select {
+		case response = <-request.response:
+		case <-r.Context().Done():
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if response.Error != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.WithFields(log.Fields{
+				"op":    "evaluateHandler",
+				"error": err,
+			}).Warn("failed to write evaluation response")
+		}
+	})
+}
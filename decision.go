@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Start rules supported by Query.StartRule
+const (
+	StartRuleBothDry       = "both-dry"
+	StartRuleFutureOnlyDry = "future-only-dry"
+	StartRuleMax           = "max"
+	StartRuleWeighted      = "weighted"
+	StartRuleExpression    = "expression"
+)
+
+// Reason codes are stable, machine-readable identifiers for decision reasons
+const (
+	ReasonDry            = "DRY"
+	ReasonPastPrecip     = "PAST_PRECIP"
+	ReasonFuturePrecip   = "FUTURE_PRECIP"
+	ReasonBothPrecip     = "BOTH_PRECIP"
+	ReasonMaxPrecip      = "MAX_PRECIP"
+	ReasonWeightedPrecip = "WEIGHTED_PRECIP"
+	ReasonLowConfidence  = "LOW_CONFIDENCE"
+	ReasonHighPoP        = "HIGH_PRECIP_PROBABILITY"
+	ReasonNoData         = "NO_DATA"
+	ReasonVacuumBusy     = "VACUUM_BUSY"
+	ReasonSoilWet        = "SOIL_WET"
+	ReasonForced         = "FORCED"
+	ReasonFewDryDays     = "FEW_DRY_DAYS"
+	ReasonRainNotNear    = "RAIN_NOT_IMMINENT"
+	ReasonExpression     = "EXPRESSION_FALSE"
+	ReasonDew            = "DEW"
+	ReasonRecentRain     = "RECENT_RAIN"
+	ReasonStaleData      = "STALE_DATA"
+	ReasonDisagreement   = "SOURCES_DISAGREE"
+	ReasonRuleMatched    = "RULE_MATCHED"
+	ReasonNoRuleMatched  = "NO_RULE_MATCHED"
+	ReasonSevereWeather  = "SEVERE_WEATHER"
+	ReasonCondition      = "CONDITION"
+	ReasonFailsafe       = "FAILSAFE"
+	ReasonOutsideWindow  = "OUTSIDE_ALLOWED_WINDOW"
+	ReasonConflict       = "CONFLICT"
+)
+
+// Policies for the stop action when the forecast holds no data
+const (
+	StopNoDataError = "error"
+	StopNoDataStop  = "stop"
+	StopNoDataLeave = "leave"
+)
+
+// Decision is the outcome of evaluating the precipitation data for an action
+type Decision struct {
+	Act    bool
+	Code   string
+	Reason string
+}
+
+// pastThreshold is the lookback precipitation at or below which the past
+// counts as dry for the start: PastPrecipThreshold when set, otherwise
+// StartThreshold.
+func (q Query) pastThreshold() float64 {
+	if q.PastPrecipThreshold > 0 {
+		return q.PastPrecipThreshold
+	}
+	return q.StartThreshold
+}
+
+// futureThreshold is the lookforward precipitation at or below which the
+// future counts as dry for the start: FuturePrecipThreshold when set,
+// otherwise StartThreshold.
+func (q Query) futureThreshold() float64 {
+	if q.FuturePrecipThreshold > 0 {
+		return q.FuturePrecipThreshold
+	}
+	return q.StartThreshold
+}
+
+// startWindowThresholds returns the thresholds the start rule compares the
+// lookback and lookforward precipitation against.
+func (q Query) startWindowThresholds() (float64, float64) {
+	if q.StartRule == StartRuleMax && !q.SkipLookback {
+		return q.StartThreshold, q.StartThreshold
+	}
+	return q.pastThreshold(), q.futureThreshold()
+}
+
+// DecideStart applies the configured start rule to the past and future
+// precipitation and decides whether the vacuum should be started. With
+// SkipLookback only the future precipitation is considered.
+func DecideStart(query Query, pastPrecip float64, futurePrecip float64) Decision {
+	if query.SkipLookback {
+		query.StartRule = StartRuleFutureOnlyDry
+	}
+	threshold := query.StartThreshold
+	pastWet := pastPrecip > query.pastThreshold()
+	futureWet := futurePrecip > query.futureThreshold()
+
+	switch query.StartRule {
+	case StartRuleFutureOnlyDry:
+		if futureWet {
+			return Decision{Code: ReasonFuturePrecip, Reason: "precipitation found in future forecast, not starting vacuum"}
+		}
+		return Decision{Act: true, Code: ReasonDry, Reason: "started robot vacuum based on no precipitation in future forecast"}
+	case StartRuleMax:
+		if max(pastPrecip, futurePrecip) > threshold {
+			return Decision{Code: ReasonMaxPrecip, Reason: "maximum of past and future precipitation exceeds threshold, not starting vacuum"}
+		}
+		return Decision{Act: true, Code: ReasonDry, Reason: "started robot vacuum based on maximum precipitation within threshold"}
+	case StartRuleWeighted:
+		if query.PastWeight*pastPrecip+query.FutureWeight*futurePrecip > threshold {
+			return Decision{Code: ReasonWeightedPrecip, Reason: "weighted precipitation exceeds threshold, not starting vacuum"}
+		}
+		return Decision{Act: true, Code: ReasonDry, Reason: "started robot vacuum based on weighted precipitation within threshold"}
+	case StartRuleExpression:
+		// the expression was checked when the configuration was validated
+		expr, err := ParseStartExpression(query.StartExpression)
+		if err == nil {
+			var start bool
+			start, err = EvalStartExpression(expr, pastPrecip, futurePrecip)
+			if err == nil && start {
+				return Decision{Act: true, Code: ReasonDry, Reason: "started robot vacuum based on start expression"}
+			}
+		}
+		if err != nil {
+			return Decision{Code: ReasonExpression, Reason: fmt.Sprintf("%s, not starting vacuum", err)}
+		}
+		return Decision{Code: ReasonExpression, Reason: "start expression is false, not starting vacuum"}
+	}
+
+	switch {
+	case pastWet && futureWet:
+		return Decision{Code: ReasonBothPrecip, Reason: "precipitation found both in past and future forecast, not starting vacuum"}
+	case pastWet:
+		return Decision{Code: ReasonPastPrecip, Reason: "precipitation found in past weather, not starting vacuum"}
+	case futureWet:
+		return Decision{Code: ReasonFuturePrecip, Reason: "precipitation found in future forecast, not starting vacuum"}
+	}
+	return Decision{Act: true, Code: ReasonDry, Reason: "started robot vacuum based on no precipitation in forecast"}
+}
+
+// DecideStop decides whether the vacuum should be stopped, or sent back to
+// base, based on the future precipitation exceeding FuturePrecipThreshold.
+func DecideStop(vacuum Vacuum, query Query, futurePrecip float64) Decision {
+	if futurePrecip <= query.FuturePrecipThreshold {
+		return Decision{Code: ReasonDry, Reason: "forecast is dry, not stopping vacuum"}
+	}
+	if vacuum.ReturnToBase {
+		return Decision{Act: true, Code: ReasonFuturePrecip, Reason: "sent robot vacuum back to base based on precipitation in forecast"}
+	}
+	return Decision{Act: true, Code: ReasonFuturePrecip, Reason: "stopped robot vacuum based on precipitation in forecast"}
+}
+
+// ApplyStopLeadTime vetoes a stop decision when the first precipitation is
+// further away than Vacuum.StopLeadTime, letting the vacuum finish its cycle.
+func ApplyStopLeadTime(vacuum Vacuum, decision Decision, untilWet time.Duration) Decision {
+	if !decision.Act || untilWet <= vacuum.StopLeadTime {
+		return decision
+	}
+	return Decision{Code: ReasonRainNotNear, Reason: fmt.Sprintf("precipitation expected in %s, beyond the stop lead time of %s, not stopping vacuum",
+		untilWet.Round(time.Minute), vacuum.StopLeadTime)}
+}
+
+// DecideStopNoData decides the stop action when the lookforward window holds
+// no data, according to Query.StopNoDataPolicy. The error policy leaves the
+// decision to the caller, which should fail the run.
+func DecideStopNoData(vacuum Vacuum, policy string) (Decision, bool) {
+	switch policy {
+	case StopNoDataStop:
+		if vacuum.ReturnToBase {
+			return Decision{Act: true, Code: ReasonNoData, Reason: "sent robot vacuum back to base as no forecast data was found"}, true
+		}
+		return Decision{Act: true, Code: ReasonNoData, Reason: "stopped robot vacuum as no forecast data was found"}, true
+	case StopNoDataLeave:
+		return Decision{Code: ReasonNoData, Reason: "no forecast data found, not stopping vacuum"}, true
+	}
+	return Decision{}, false
+}
+
+// ForcedDecision is the decision for an action forced from the command line,
+// bypassing every query and guard.
+func ForcedDecision(vacuum Vacuum, action string) Decision {
+	switch {
+	case action == "start":
+		return Decision{Act: true, Code: ReasonForced, Reason: "forced start of robot vacuum"}
+	case vacuum.ReturnToBase:
+		return Decision{Act: true, Code: ReasonForced, Reason: "forced robot vacuum back to base"}
+	}
+	return Decision{Act: true, Code: ReasonForced, Reason: "forced stop of robot vacuum"}
+}
+
+// ApplyConfidence vetoes a start decision when the forecast confidence does
+// not exceed the configured minimum.
+func ApplyConfidence(confidence Confidence, decision Decision, value float64) Decision {
+	if !decision.Act || value > confidence.Minimum {
+		return decision
+	}
+	return Decision{Code: ReasonLowConfidence, Reason: fmt.Sprintf("forecast confidence %v is not above minimum %v, not starting vacuum",
+		value, confidence.Minimum)}
+}
+
+// ApplyProbability vetoes a start decision when the probability of
+// precipitation exceeds the configured maximum.
+func ApplyProbability(probability Probability, decision Decision, value float64) Decision {
+	if !decision.Act || value <= *probability.Maximum {
+		return decision
+	}
+	return Decision{Code: ReasonHighPoP, Reason: fmt.Sprintf("probability of precipitation %v%% exceeds maximum %v%%, not starting vacuum",
+		value, *probability.Maximum)}
+}
+
+// ApplyDryDays vetoes a start decision unless at least DryDaysRequired of the
+// daily maxima are within the start threshold.
+func ApplyDryDays(query Query, decision Decision, daily []float64) Decision {
+	if !decision.Act {
+		return decision
+	}
+	var dry int
+	for _, value := range daily {
+		if value <= query.pastThreshold() {
+			dry++
+		}
+	}
+	if dry >= query.DryDaysRequired {
+		return decision
+	}
+	return Decision{Code: ReasonFewDryDays, Reason: fmt.Sprintf("only %d of the last %d days were dry, %d required, not starting vacuum",
+		dry, query.DryDaysWindow, query.DryDaysRequired)}
+}
+
+// ApplyRainRecency vetoes a start decision when the last precipitation fell
+// less than Query.MinDrySince ago, giving the ground time to dry out.
+func ApplyRainRecency(query Query, decision Decision, minutesSinceRain float64) Decision {
+	if !decision.Act {
+		return decision
+	}
+	minDrySince, err := ParseFluxDuration(query.MinDrySince)
+	if err != nil || minutesSinceRain >= minDrySince.Minutes() {
+		return decision
+	}
+	return Decision{Code: ReasonRecentRain, Reason: fmt.Sprintf("last precipitation was %.0f minutes ago, less than %s, not starting vacuum",
+		minutesSinceRain, query.MinDrySince)}
+}
+
+// Disagree reports whether the observed precipitation and the forecast for
+// the same past window disagree about it having been wet.
+func Disagree(query Query, pastPrecip float64, observed float64) bool {
+	return (observed > query.pastThreshold()) != (pastPrecip > query.pastThreshold())
+}
+
+// ApplyObserved vetoes a start decision unless the observed precipitation
+// agrees that the past window was dry. A disagreement is treated as wet.
+func ApplyObserved(query Query, decision Decision, pastPrecip float64, observed float64) Decision {
+	if !decision.Act || observed <= query.pastThreshold() {
+		return decision
+	}
+	if Disagree(query, pastPrecip, observed) {
+		return Decision{Code: ReasonDisagreement, Reason: fmt.Sprintf("observed precipitation %v disagrees with dry forecast %v, not starting vacuum",
+			observed, pastPrecip)}
+	}
+	return Decision{Code: ReasonPastPrecip, Reason: "observed precipitation found in past weather, not starting vacuum"}
+}
+
+// ApplyDew vetoes a start decision when the forecast temperature comes within
+// Dew.Margin of the dew point, so condensation is likely to wet the surface.
+func ApplyDew(dew Dew, decision Decision, spread float64) Decision {
+	if !decision.Act || spread > dew.Margin {
+		return decision
+	}
+	return Decision{Code: ReasonDew, Reason: fmt.Sprintf("forecast temperature comes within %v of the dew point, dew likely, not starting vacuum",
+		spread)}
+}
+
+// ApplySoilMoisture vetoes a start decision when the soil moisture reading
+// exceeds the configured maximum, regardless of the precipitation.
+func ApplySoilMoisture(soil SoilMoisture, decision Decision, value float64) Decision {
+	if !decision.Act || value <= soil.Maximum {
+		return decision
+	}
+	return Decision{Code: ReasonSoilWet, Reason: fmt.Sprintf("soil moisture %v exceeds maximum %v, not starting vacuum",
+		value, soil.Maximum)}
+}
+
+// ApplyVacuumStatus vetoes a start decision unless the vacuum reports one of
+// the configured idle states, so a running vacuum is not interrupted or
+// triggered twice.
+func ApplyVacuumStatus(vacuum Vacuum, decision Decision, status string) Decision {
+	if !decision.Act {
+		return decision
+	}
+	for _, idle := range vacuum.IdleValues {
+		if status == idle {
+			return decision
+		}
+	}
+	return Decision{Code: ReasonVacuumBusy, Reason: fmt.Sprintf("robot vacuum reports %s rather than idle, not starting vacuum", status)}
+}
+
+// DecideRules evaluates the start rules in order and returns the first one
+// whose expression holds, along with the decision to start. When no rule
+// matches the returned rule is nil.
+func DecideRules(rules []Rule, pastPrecip float64, futurePrecip float64) (Decision, *Rule) {
+	for i := range rules {
+		// the expressions were checked when the configuration was validated
+		expr, err := ParseStartExpression(rules[i].Expression)
+		if err != nil {
+			return Decision{Code: ReasonExpression, Reason: fmt.Sprintf("rule %s, %s, not starting vacuum", rules[i].Name, err)}, nil
+		}
+		match, err := EvalStartExpression(expr, pastPrecip, futurePrecip)
+		if err != nil {
+			return Decision{Code: ReasonExpression, Reason: fmt.Sprintf("rule %s, %s, not starting vacuum", rules[i].Name, err)}, nil
+		}
+		if match {
+			return Decision{Act: true, Code: ReasonRuleMatched, Reason: fmt.Sprintf("started robot vacuum based on rule %s", rules[i].Name)}, &rules[i]
+		}
+	}
+	return Decision{Code: ReasonNoRuleMatched, Reason: "no rule matched, not starting vacuum"}, nil
+}
+
+// Policies combining the conditions blocking a start
+const (
+	ConditionPolicyAny = "any"
+	ConditionPolicyAll = "all"
+)
+
+// Windows a condition can be evaluated over
+const (
+	ConditionWindowLookback    = "lookback"
+	ConditionWindowLookforward = "lookforward"
+)
+
+// conditionAggregations are the Flux functions a condition window can be
+// reduced with
+var conditionAggregations = []string{"max", "min", "mean", "last"}
+
+// ConditionMet reports whether a condition's value satisfies its comparison.
+func ConditionMet(condition Condition, value float64) bool {
+	switch condition.Operator {
+	case ">":
+		return value > condition.Value
+	case ">=":
+		return value >= condition.Value
+	case "<":
+		return value < condition.Value
+	case "<=":
+		return value <= condition.Value
+	case "==":
+		return value == condition.Value
+	case "!=":
+		return value != condition.Value
+	}
+	return false
+}
+
+// ApplyConditions vetoes a start decision when the conditions block it: when
+// any of them is met, or with the all policy only when every one is.
+func ApplyConditions(query Query, decision Decision, values []float64) Decision {
+	if !decision.Act || len(query.Conditions) == 0 {
+		return decision
+	}
+	var met []string
+	for i, condition := range query.Conditions {
+		if ConditionMet(condition, values[i]) {
+			met = append(met, fmt.Sprintf("%s %v %s %v", condition.Name, values[i], condition.Operator, condition.Value))
+		}
+	}
+	blocked := len(met) > 0
+	if query.ConditionPolicy == ConditionPolicyAll {
+		blocked = len(met) == len(query.Conditions)
+	}
+	if !blocked {
+		return decision
+	}
+	return Decision{Code: ReasonCondition, Reason: fmt.Sprintf("condition %s met, not starting vacuum", strings.Join(met, ", "))}
+}
+
+// validateConditions checks each condition and the policy combining them.
+func validateConditions(query Query) error {
+	switch query.ConditionPolicy {
+	case "", ConditionPolicyAny, ConditionPolicyAll:
+	default:
+		return fmt.Errorf("unknown condition policy %s", query.ConditionPolicy)
+	}
+	for i, condition := range query.Conditions {
+		if condition.Name == "" {
+			return fmt.Errorf("condition %d must have a name", i+1)
+		}
+		if condition.Measurement == "" || condition.Field == "" {
+			return fmt.Errorf("condition %s must have a measurement and field", condition.Name)
+		}
+		switch condition.Window {
+		case "", ConditionWindowLookback, ConditionWindowLookforward:
+		default:
+			return fmt.Errorf("condition %s has unknown window %s", condition.Name, condition.Window)
+		}
+		if condition.Aggregation != "" && !slices.Contains(conditionAggregations, condition.Aggregation) {
+			return fmt.Errorf("condition %s has unknown aggregation %s", condition.Name, condition.Aggregation)
+		}
+		if !slices.Contains([]string{">", ">=", "<", "<=", "==", "!="}, condition.Operator) {
+			return fmt.Errorf("condition %s has unknown operator %s", condition.Name, condition.Operator)
+		}
+	}
+	return nil
+}
+
+// SevereWeatherActive reports whether a severe weather alert value is set:
+// true, a non-zero number or the string true.
+func SevereWeatherActive(value interface{}) bool {
+	if number, ok := toFloat(value); ok {
+		return number != 0
+	}
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		active, err := strconv.ParseBool(v)
+		return err == nil && active
+	}
+	return false
+}
+
+// SevereWeatherDecision is the decision for an action while a severe weather
+// alert is set: stop the vacuum, or refuse to start it.
+func SevereWeatherDecision(action string) Decision {
+	if action == "stop" {
+		return Decision{Act: true, Code: ReasonSevereWeather, Reason: "stopped robot vacuum due to severe weather alert"}
+	}
+	return Decision{Code: ReasonSevereWeather, Reason: "severe weather alert is set, not starting vacuum"}
+}
+
+// validateRules checks that each rule has a valid expression and a webhook.
+// With another protocol a rule without a webhook sends the regular start
+// command.
+func validateRules(c *Configuration) error {
+	for i, rule := range c.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d must have a name", i+1)
+		}
+		if rule.Expression == "" {
+			return fmt.Errorf("rule %s must have an expression", rule.Name)
+		}
+		if _, err := ParseStartExpression(rule.Expression); err != nil {
+			return fmt.Errorf("rule %s, %s", rule.Name, err)
+		}
+		if rule.Webhook.URL == "" && c.Vacuum.usesWebhooks() {
+			return fmt.Errorf("rule %s must have a webhook url", rule.Name)
+		}
+		if _, err := WebhookURLs(c, rule.Webhook.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateStartRule checks that the configured start rule is one we know how
+// to evaluate.
+func validateStartRule(query Query) error {
+	if query.SkipLookback && query.StartRule != "" && query.StartRule != StartRuleBothDry && query.StartRule != StartRuleFutureOnlyDry {
+		return fmt.Errorf("skipLookback cannot be combined with start rule %s", query.StartRule)
+	}
+	switch query.StartRule {
+	case "", StartRuleBothDry, StartRuleFutureOnlyDry, StartRuleMax:
+		return nil
+	case StartRuleWeighted:
+		if query.PastWeight == 0 && query.FutureWeight == 0 {
+			return fmt.Errorf("start rule %s requires pastWeight and/or futureWeight", StartRuleWeighted)
+		}
+		return nil
+	case StartRuleExpression:
+		if query.StartExpression == "" {
+			return fmt.Errorf("start rule %s requires startExpression", StartRuleExpression)
+		}
+		_, err := ParseStartExpression(query.StartExpression)
+		return err
+	}
+	return fmt.Errorf("unknown start rule %s", query.StartRule)
+}
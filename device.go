@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Device is one of several vacuums managed from a single config, e.g. a mower
+// and a patio sweeper with different rain tolerances. Its vacuum settings
+// replace the top-level vacuum and its query overrides are merged over the
+// top-level query; unset overrides keep the default. The precipitation
+// windows are shared by every device.
+type Device struct {
+	Name   string
+	Vacuum Vacuum
+	Query  DeviceQuery
+}
+
+// DeviceQuery holds the query settings a device may override
+type DeviceQuery struct {
+	StartThreshold        *float64
+	PastPrecipThreshold   *float64
+	FuturePrecipThreshold *float64
+}
+
+// deviceNamePattern keeps device names usable as file name suffixes and
+// metric labels
+var deviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ForDevice returns a copy of the configuration acting for the device. The
+// state and Prometheus files get the device name as suffix so that devices
+// keep separate state.
+func (c *Configuration) ForDevice(device Device) *Configuration {
+	derived := *c
+	derived.Vacuums = nil
+	derived.device = device.Name
+	derived.Vacuum = device.Vacuum
+	if device.Query.StartThreshold != nil {
+		derived.Query.StartThreshold = *device.Query.StartThreshold
+	}
+	if device.Query.PastPrecipThreshold != nil {
+		derived.Query.PastPrecipThreshold = *device.Query.PastPrecipThreshold
+	}
+	if device.Query.FuturePrecipThreshold != nil {
+		derived.Query.FuturePrecipThreshold = *device.Query.FuturePrecipThreshold
+	}
+	if derived.StateFile != "" {
+		derived.StateFile += "." + device.Name
+	}
+	if derived.PrometheusFile != "" {
+		derived.PrometheusFile += "." + device.Name
+	}
+	return &derived
+}
+
+// EvaluateDevices evaluates the action for every configured device in turn,
+// or for the top-level vacuum when no devices are configured. A failing
+// device does not keep the others from being evaluated; the errors are
+// joined.
+func EvaluateDevices(ctx context.Context, configuration *Configuration, cliInputs CliInputs, source Source) error {
+	if len(configuration.Vacuums) == 0 {
+		return Evaluate(ctx, configuration, cliInputs, source)
+	}
+	var errs []error
+	for _, device := range configuration.Vacuums {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := Evaluate(ctx, configuration.ForDevice(device), cliInputs, source); err != nil {
+			errs = append(errs, fmt.Errorf("device %s, %w", device.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateDevices checks that the devices have unique, usable names and that
+// the configuration derived for each is valid.
+func validateDevices(c *Configuration) error {
+	seen := make(map[string]bool, len(c.Vacuums))
+	for i, device := range c.Vacuums {
+		if !deviceNamePattern.MatchString(device.Name) {
+			return fmt.Errorf("vacuums entry %d must have a name of letters, digits, - and _", i+1)
+		}
+		if seen[device.Name] {
+			return fmt.Errorf("duplicate vacuum name %s", device.Name)
+		}
+		seen[device.Name] = true
+		if err := c.ForDevice(device).Validate(); err != nil {
+			return fmt.Errorf("vacuum %s, %s", device.Name, err)
+		}
+	}
+	return nil
+}
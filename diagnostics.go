@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// diagnosticQuery is a named Flux query run by RunDiagnostics
+type diagnosticQuery struct {
+	name       string
+	connection *influxConnection
+	query      string
+}
+
+// RunDiagnostics runs every configured query regardless of the action and
+// writes a table of each value retrieved, with the series it belongs to. No
+// webhooks are called.
+func RunDiagnostics(ctx context.Context, config *Configuration, source Source, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "QUERY\tSERIES\tTIME\tVALUE")
+
+	switch s := source.(type) {
+	case *InfluxSource:
+		if err := s.diagnose(ctx, tw); err != nil {
+			return err
+		}
+	default:
+		origin := config.CSV.Path
+		switch config.Source {
+		case SourceAPI:
+			origin = config.API.URL
+		case SourceForecast:
+			origin = config.Forecast.Provider
+		case "", SourceInfluxDB:
+			origin = config.InfluxDB.Address
+		}
+		pastThreshold, futureThreshold := config.Query.startWindowThresholds()
+		lookback, err := source.Lookback(ctx, pastThreshold)
+		if err != nil {
+			return fmt.Errorf("lookback query failed, %s", err)
+		}
+		fmt.Fprintf(tw, "lookback\t%s\t\t%v\n", origin, lookback)
+		lookforward, err := source.Lookforward(ctx, futureThreshold)
+		if err != nil {
+			return fmt.Errorf("lookforward query failed, %s", err)
+		}
+		fmt.Fprintf(tw, "lookforward\t%s\t\t%v\n", origin, lookforward)
+	}
+
+	return tw.Flush()
+}
+
+// PrintQueries writes the lookback and lookforward Flux queries that would be
+// run, without connecting to InfluxDB. When several buckets are configured
+// the queries are printed for each since the freshest is chosen at runtime.
+// Likewise the nearest point of Query.Location is only known at runtime, so
+// the query resolving it is printed and its filter is left out. With InfluxQL
+// the queries for the current windows are printed instead.
+func PrintQueries(config *Configuration, w io.Writer) error {
+	if (config.Source == "" || config.Source == SourceInfluxDB) && config.InfluxDB.QueryLanguage == QueryLanguageInfluxQL {
+		return printInfluxQLQueries(config, w)
+	}
+	if !config.usesInflux() {
+		return fmt.Errorf("printing queries requires the influxdb source")
+	}
+	db := config.InfluxDB
+	if config.Query.Connection != "" {
+		db = config.Connections[strings.ToLower(config.Query.Connection)]
+	}
+	buckets := db.Buckets
+	if len(buckets) == 0 {
+		bucket, err := influxBucket(db)
+		if err != nil {
+			return err
+		}
+		buckets = []string{bucket}
+	}
+
+	for _, bucket := range buckets {
+		if config.Query.Location.LatitudeTag != "" {
+			fmt.Fprintf(w, "// nearest point (bucket %s)\n%s\n\n", bucket, NearestPointQuery(config, bucket))
+		}
+		lookback, err := LookbackQuery(config, bucket)
+		if err != nil {
+			return err
+		}
+		lookforward, err := LookforwardQuery(config, bucket)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "// lookback (bucket %s)\n%s\n\n// lookforward (bucket %s)\n%s\n", bucket, lookback, bucket, lookforward)
+	}
+	return nil
+}
+
+// printInfluxQLQueries writes the InfluxQL selecting the points of the current
+// lookback and lookforward windows.
+func printInfluxQLQueries(config *Configuration, w io.Writer) error {
+	source := NewInfluxQLSource(config)
+	start, stop, err := source.lookbackWindow()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "-- lookback (database %s)\n%s\n\n", config.InfluxDB.Database, InfluxQLQuery(config, start, stop))
+	start, stop, err = source.lookforwardWindow()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "-- lookforward (database %s)\n%s\n", config.InfluxDB.Database, InfluxQLQuery(config, start, stop))
+	return nil
+}
+
+// diagnose runs each InfluxDB query and writes every record returned.
+func (s *InfluxSource) diagnose(ctx context.Context, w io.Writer) error {
+	lookback, err := LookbackQuery(s.config, s.bucket)
+	if err != nil {
+		return err
+	}
+	lookforward, err := LookforwardQuery(s.config, s.bucket)
+	if err != nil {
+		return err
+	}
+	precip, err := s.connection("")
+	if err != nil {
+		return err
+	}
+	queries := []diagnosticQuery{
+		{name: "lookback", connection: precip, query: lookback},
+		{name: "lookforward", connection: precip, query: lookforward},
+	}
+	if s.config.Confidence.Field != "" {
+		connection, err := s.connection(s.config.Confidence.Connection)
+		if err != nil {
+			return err
+		}
+		measurement := s.config.Confidence.Measurement
+		if measurement == "" {
+			measurement = s.config.InfluxDB.Measurement
+		}
+		queries = append(queries, diagnosticQuery{
+			name:       "confidence",
+			connection: connection,
+			query:      ForecastMinQuery(s.config, connection.bucket, measurement, s.config.Confidence.Field),
+		})
+	}
+	if s.config.Probability.Maximum != nil {
+		connection, err := s.connection(s.config.Probability.Connection)
+		if err != nil {
+			return err
+		}
+		measurement := s.config.Probability.Measurement
+		if measurement == "" {
+			measurement = s.config.InfluxDB.Measurement
+		}
+		queries = append(queries, diagnosticQuery{
+			name:       "probability",
+			connection: connection,
+			query:      ForecastMaxQuery(s.config, connection.bucket, measurement, s.config.Probability.Field),
+		})
+	}
+	if s.config.Observed.Field != "" {
+		connection, err := s.connection(s.config.Observed.Connection)
+		if err != nil {
+			return err
+		}
+		queries = append(queries, diagnosticQuery{
+			name:       "observed",
+			connection: connection,
+			query:      ObservedMaxQuery(s.config, connection.bucket),
+		})
+	}
+	if s.config.Dew.TemperatureField != "" {
+		connection, err := s.connection(s.config.Dew.Connection)
+		if err != nil {
+			return err
+		}
+		queries = append(queries, diagnosticQuery{
+			name:       "dewPointSpread",
+			connection: connection,
+			query:      DewPointSpreadQuery(s.config, connection.bucket),
+		})
+	}
+	if s.config.Query.MinDrySince != "" {
+		query, err := MinutesSinceRainQuery(s.config, s.bucket, s.config.Query.pastThreshold())
+		if err != nil {
+			return err
+		}
+		queries = append(queries, diagnosticQuery{
+			name:       "minutesSinceRain",
+			connection: precip,
+			query:      query,
+		})
+	}
+	if s.config.Query.DryDaysRequired > 0 {
+		queries = append(queries, diagnosticQuery{
+			name:       "dryDays",
+			connection: precip,
+			query:      DryDaysQuery(s.config, s.bucket),
+		})
+	}
+	for _, condition := range s.config.Query.Conditions {
+		connection, err := s.connection(condition.Connection)
+		if err != nil {
+			return err
+		}
+		queries = append(queries, diagnosticQuery{
+			name:       "condition " + condition.Name,
+			connection: connection,
+			query:      ConditionQuery(s.config, connection.bucket, condition),
+		})
+	}
+	if s.config.SevereWeather.Field != "" {
+		connection, err := s.connection(s.config.SevereWeather.Connection)
+		if err != nil {
+			return err
+		}
+		maxAge := s.config.SevereWeather.MaxAge
+		if maxAge <= 0 {
+			maxAge = defaultSevereWeatherMaxAge
+		}
+		queries = append(queries, diagnosticQuery{
+			name:       "severeWeather",
+			connection: connection,
+			query:      LatestValueQuery(connection.bucket, s.config.SevereWeather.Measurement, s.config.SevereWeather.Field, maxAge),
+		})
+	}
+	if s.config.SoilMoisture.Field != "" {
+		connection, err := s.connection(s.config.SoilMoisture.Connection)
+		if err != nil {
+			return err
+		}
+		maxAge := s.config.SoilMoisture.MaxAge
+		if maxAge <= 0 {
+			maxAge = defaultSoilMoistureMaxAge
+		}
+		queries = append(queries, diagnosticQuery{
+			name:       "soilMoisture",
+			connection: connection,
+			query:      LatestValueQuery(connection.bucket, s.config.SoilMoisture.Measurement, s.config.SoilMoisture.Field, maxAge),
+		})
+	}
+
+	for _, q := range queries {
+		result, err := q.connection.queryAPI.Query(ctx, q.query)
+		if err != nil {
+			return fmt.Errorf("%s query failed, %s", q.name, err)
+		}
+		rows := 0
+		for result.Next() {
+			record := result.Record()
+			var timestamp string
+			if !record.Time().IsZero() {
+				timestamp = record.Time().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", q.name, seriesIdentity(record.Values()), timestamp, record.Value())
+			rows++
+		}
+		if result.Err() != nil {
+			result.Close()
+			return fmt.Errorf("failed parsing %s data from InfluxDB, %s", q.name, result.Err())
+		}
+		result.Close()
+		if rows == 0 {
+			fmt.Fprintf(w, "%s\t(no data)\t\t\n", q.name)
+		}
+	}
+	return nil
+}
+
+// seriesIdentity describes a Flux record by its measurement, field and tags.
+func seriesIdentity(values map[string]interface{}) string {
+	var keys []string
+	for key := range values {
+		switch key {
+		case "result", "table", "_start", "_stop", "_time", "_value":
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s=%v", key, values[key])
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// RunSummary describes the outcome of a single run. It is logged at the end of
+// every run, posted to the event webhook and written to the event socket and
+// prometheus file when they are configured and printed with -metrics-json.
+type RunSummary struct {
+	Timestamp     time.Time     `json:"timestamp"`
+	CorrelationID string        `json:"correlation_id"`
+	Device        string        `json:"device,omitempty"`
+	Action        string        `json:"action"`
+	Success       bool          `json:"success"`
+	Act           bool          `json:"act"`
+	ReasonCode    string        `json:"reason_code"`
+	Reason        string        `json:"reason"`
+	PastPrecip    float64       `json:"past_precip"`
+	FuturePrecip  float64       `json:"future_precip"`
+	WebhookFired  bool          `json:"webhook_fired"`
+	DryRun        bool          `json:"dry_run,omitempty"`
+	Duration      time.Duration `json:"duration_ns"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// WriteMetricsJSON writes the run summary as a single line of JSON, e.g. for
+// piping to a pushgateway from cron.
+func WriteMetricsJSON(w io.Writer, summary RunSummary) error {
+	return json.NewEncoder(w).Encode(summary)
+}
+
+// PostEvent sends the run summary as JSON to the event webhook. Unlike the
+// control webhooks it is called on every run, including runs that take no
+// action.
+func PostEvent(config *Configuration, summary RunSummary) error {
+	return postJSON(config, config.EventWebhook, summary)
+}
+
+// defaultEventSocketTimeout bounds connecting and writing to the event socket
+const defaultEventSocketTimeout = 5 * time.Second
+
+// WriteEventSocket writes the run summary as a line of JSON to the event
+// socket, which is either a unix socket or a named pipe. A pipe must already
+// be open for reading.
+func WriteEventSocket(config *Configuration, summary RunSummary) error {
+	path := config.EventSocket.Path
+	var w io.WriteCloser
+	info, err := os.Stat(path)
+	if err == nil && info.Mode()&fs.ModeNamedPipe != 0 {
+		w, err = openFIFO(path)
+	} else {
+		var conn net.Conn
+		conn, err = net.DialTimeout("unix", path, defaultEventSocketTimeout)
+		if err == nil {
+			err = conn.SetWriteDeadline(time.Now().Add(defaultEventSocketTimeout))
+			w = conn
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open event socket %s, %s", path, err)
+	}
+	defer w.Close()
+
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		return fmt.Errorf("unable to write to event socket %s, %s", path, err)
+	}
+	return nil
+}
+
+// postJSON POSTs the payload encoded as JSON and checks for a 2xx response.
+func postJSON(config *Configuration, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to encode payload, %s", err)
+	}
+
+	client := &http.Client{Timeout: config.Vacuum.Timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %s", url, resp.Status)
+	}
+	return nil
+}
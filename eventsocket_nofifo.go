@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// openFIFO reports that named pipes are unavailable on this platform.
+func openFIFO(path string) (*os.File, error) {
+	return nil, fmt.Errorf("named pipes are not supported on this platform")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+)
+
+// ParseStartExpression parses a boolean start expression over the variables
+// past and future, e.g. past <= 0.1 && future == 0. The syntax is that of Go
+// expressions restricted to numbers, the two variables, true and false,
+// parentheses and the arithmetic, comparison and logical operators. The
+// expression is checked by evaluating it once so that malformed expressions
+// are caught when the configuration is validated.
+func ParseStartExpression(source string) (ast.Expr, error) {
+	expr, err := parser.ParseExpr(source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse start expression, %s", err)
+	}
+	if _, err := EvalStartExpression(expr, 0, 0); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// EvalStartExpression evaluates a parsed start expression with the given past
+// and future precipitation.
+func EvalStartExpression(expr ast.Expr, pastPrecip float64, futurePrecip float64) (bool, error) {
+	value, err := evalExpression(expr, map[string]interface{}{
+		"past":   pastPrecip,
+		"future": futurePrecip,
+		"true":   true,
+		"false":  false,
+	})
+	if err != nil {
+		return false, fmt.Errorf("invalid start expression, %s", err)
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("invalid start expression, result is %v rather than true or false", value)
+	}
+	return result, nil
+}
+
+// evalExpression evaluates an expression node to a float64 or a bool.
+func evalExpression(expr ast.Expr, vars map[string]interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return evalExpression(e.X, vars)
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT {
+			return nil, fmt.Errorf("unsupported literal %s", e.Value)
+		}
+		return strconv.ParseFloat(e.Value, 64)
+	case *ast.Ident:
+		value, ok := vars[e.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s", e.Name)
+		}
+		return value, nil
+	case *ast.UnaryExpr:
+		operand, err := evalExpression(e.X, vars)
+		if err != nil {
+			return nil, err
+		}
+		switch v := operand.(type) {
+		case bool:
+			if e.Op == token.NOT {
+				return !v, nil
+			}
+		case float64:
+			switch e.Op {
+			case token.SUB:
+				return -v, nil
+			case token.ADD:
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("operator %s cannot be applied to %v", e.Op, operand)
+	case *ast.BinaryExpr:
+		return evalBinary(e, vars)
+	}
+	return nil, fmt.Errorf("unsupported expression at offset %d", expr.Pos())
+}
+
+// evalBinary evaluates a binary expression. The logical operators short
+// circuit, but both operands are still required to be booleans.
+func evalBinary(e *ast.BinaryExpr, vars map[string]interface{}) (interface{}, error) {
+	left, err := evalExpression(e.X, vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := evalExpression(e.Y, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := left.(bool); ok {
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s cannot combine %v and %v", e.Op, left, right)
+		}
+		switch e.Op {
+		case token.LAND:
+			return l && r, nil
+		case token.LOR:
+			return l || r, nil
+		case token.EQL:
+			return l == r, nil
+		case token.NEQ:
+			return l != r, nil
+		}
+		return nil, fmt.Errorf("operator %s cannot be applied to booleans", e.Op)
+	}
+
+	l := left.(float64)
+	r, ok := right.(float64)
+	if !ok {
+		return nil, fmt.Errorf("operator %s cannot combine %v and %v", e.Op, left, right)
+	}
+	switch e.Op {
+	case token.ADD:
+		return l + r, nil
+	case token.SUB:
+		return l - r, nil
+	case token.MUL:
+		return l * r, nil
+	case token.QUO:
+		return l / r, nil
+	case token.LSS:
+		return l < r, nil
+	case token.LEQ:
+		return l <= r, nil
+	case token.GTR:
+		return l > r, nil
+	case token.GEQ:
+		return l >= r, nil
+	case token.EQL:
+		return l == r, nil
+	case token.NEQ:
+		return l != r, nil
+	}
+	return nil, fmt.Errorf("operator %s cannot be applied to numbers", e.Op)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RecordRunOutcome counts consecutive failed runs in the state file. Once
+// Vacuum.FailsafeStopAfter is reached the stop webhook is fired so the vacuum
+// is not left running blind through an outage; a failed stop is retried on
+// the next failed run. A successful run resets the count. Only failures to
+// query or decide point at an outage: runs failing to command the vacuum or
+// run its hooks leave the count unchanged.
+func RecordRunOutcome(config *Configuration, runErr error, logger *log.Entry) error {
+	state, err := LoadState(config.StateFile)
+	if err != nil {
+		return err
+	}
+
+	if runErr == nil {
+		if state.ConsecutiveFailures == 0 && !state.FailsafeStopped {
+			return nil
+		}
+		state.ConsecutiveFailures = 0
+		state.FailsafeStopped = false
+		return state.Save(config.StateFile)
+	}
+
+	if errors.Is(runErr, ErrWebhook) || errors.Is(runErr, ErrHook) {
+		return nil
+	}
+
+	state.ConsecutiveFailures++
+	if state.ConsecutiveFailures >= config.Vacuum.FailsafeStopAfter && !state.FailsafeStopped {
+		decision := Decision{Act: true, Code: ReasonFailsafe, Reason: "stopped robot vacuum after consecutive failed runs"}
+		response, err := TriggerStopWebhook(config, NewWebhookData(config, "stop", decision, 0, 0))
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"op":       "RecordRunOutcome",
+				"failures": state.ConsecutiveFailures,
+				"error":    err,
+			}).Error("failed to stop robot vacuum after consecutive failed runs")
+		} else {
+			state.FailsafeStopped = true
+			logger.WithFields(log.Fields{
+				"op":       "RecordRunOutcome",
+				"failures": state.ConsecutiveFailures,
+				"response": truncate(response, maxResponseLogLength),
+			}).Warn("stopped robot vacuum after consecutive failed runs")
+		}
+	}
+	return state.Save(config.StateFile)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// FluxTemplateData holds the placeholders available to Flux query files.
+// Values are raw; use the flux function to quote strings, e.g.
+// from(bucket: {{flux .Bucket}}).
+type FluxTemplateData struct {
+	Imports             string
+	Bucket              string
+	Measurement         string
+	Field               string
+	Range               string
+	Start               string
+	Stop                string
+	LookbackDuration    string
+	LookforwardDuration string
+	LookforwardOffset   string
+	TagFilters          string
+	Aggregation         string
+	ValueColumn         string
+}
+
+// fluxTemplateFuncs are the functions available to Flux query files
+var fluxTemplateFuncs = template.FuncMap{
+	"flux": fluxString,
+}
+
+// RenderFluxFile loads a Flux query template from disk and renders it.
+func RenderFluxFile(path string, data FluxTemplateData) (string, error) {
+	tmpl, err := parseFluxFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var query strings.Builder
+	if err := tmpl.Execute(&query, data); err != nil {
+		return "", fmt.Errorf("unable to render Flux file %s, %s", path, err)
+	}
+	return query.String(), nil
+}
+
+// parseFluxFile reads and parses a Flux query template.
+func parseFluxFile(path string) (*template.Template, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Flux file, %s", err)
+	}
+	tmpl, err := template.New(path).Funcs(fluxTemplateFuncs).Option("missingkey=error").Parse(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse Flux file %s, %s", path, err)
+	}
+	return tmpl, nil
+}
+
+// fluxTemplateData fills in the placeholders shared by both windows.
+func fluxTemplateData(config *Configuration, bucket string) FluxTemplateData {
+	return FluxTemplateData{
+		Imports:             fluxImports(config.Query),
+		Bucket:              bucket,
+		Measurement:         config.InfluxDB.Measurement,
+		Field:               config.InfluxDB.Field,
+		LookbackDuration:    config.Query.LookbackDuration,
+		LookforwardDuration: config.Query.LookforwardDuration,
+		LookforwardOffset:   config.Query.LookforwardOffset,
+		TagFilters:          tagFilters(config.Query),
+		Aggregation:         aggregation(config.Query),
+		ValueColumn:         valueColumn(config.Query),
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Supported forecast providers
+const (
+	ForecastOpenWeatherMap = "openweathermap"
+	ForecastNWS            = "nws"
+)
+
+// ForecastSource fetches precipitation from a public forecast API selected by
+// Forecast.Provider and computes the window values in Go.
+type ForecastSource struct {
+	pointSource
+	loadProbability func() ([]precipPoint, error)
+}
+
+// NewForecastSource creates a source backed by the configured provider.
+func NewForecastSource(config *Configuration) (*ForecastSource, error) {
+	source := &ForecastSource{pointSource: pointSource{
+		config:    config,
+		now:       time.Now,
+		origin:    config.Forecast.Provider,
+		aggregate: AggregateSum,
+	}}
+	switch config.Forecast.Provider {
+	case ForecastOpenWeatherMap:
+		source.load = func(start time.Time, stop time.Time) ([]precipPoint, error) {
+			return fetchOpenWeatherMap(config, source.now(), start, stop)
+		}
+		source.loadProbability = func() ([]precipPoint, error) {
+			return fetchOpenWeatherMapProbability(config)
+		}
+	case ForecastNWS:
+		var gridURL string
+		grid := func() (string, error) {
+			if gridURL == "" {
+				var err error
+				if gridURL, err = nwsGridURL(config); err != nil {
+					return "", err
+				}
+			}
+			return gridURL, nil
+		}
+		source.load = func(time.Time, time.Time) ([]precipPoint, error) {
+			url, err := grid()
+			if err != nil {
+				return nil, err
+			}
+			return fetchNWS(config, url)
+		}
+		source.loadProbability = func() ([]precipPoint, error) {
+			url, err := grid()
+			if err != nil {
+				return nil, err
+			}
+			return fetchNWSProbability(config, url)
+		}
+	default:
+		return nil, fmt.Errorf("unknown forecast provider %s", config.Forecast.Provider)
+	}
+	return source, nil
+}
+
+// ProbabilityMax returns the highest probability of precipitation reported by
+// the provider over the lookforward window.
+func (s *ForecastSource) ProbabilityMax(ctx context.Context) (float64, error) {
+	start, stop, err := s.lookforwardWindow()
+	if err != nil {
+		return 0, err
+	}
+	points, err := s.loadProbability()
+	if err != nil {
+		return 0, err
+	}
+
+	var found bool
+	var maximum float64
+	for _, point := range points {
+		if point.time.Before(start) || !point.time.Before(stop) {
+			continue
+		}
+		if !found || point.value > maximum {
+			maximum = point.value
+			found = true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("%w for the probability of precipitation in %s between %s and %s", ErrNoData, s.origin,
+			start.Format(time.RFC3339), stop.Format(time.RFC3339))
+	}
+	return maximum, nil
+}
+
+// validateForecast checks the forecast provider settings.
+func validateForecast(forecast Forecast) error {
+	switch forecast.Provider {
+	case ForecastOpenWeatherMap:
+		if forecast.APIKey == "" {
+			return fmt.Errorf("forecast.apiKey must be set for %s", forecast.Provider)
+		}
+	case ForecastNWS:
+	default:
+		return fmt.Errorf("unknown forecast provider %s", forecast.Provider)
+	}
+	if forecast.MinProbability < 0 || forecast.MinProbability > 100 {
+		return fmt.Errorf("forecast.minProbability must be between 0 and 100")
+	}
+	if forecast.Latitude < -90 || forecast.Latitude > 90 || forecast.Longitude < -180 || forecast.Longitude > 180 {
+		return fmt.Errorf("forecast coordinates %v,%v are out of range", forecast.Latitude, forecast.Longitude)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// WriteHeartbeat records the time of a successful run in the heartbeat file
+// so an external monitor can alert when it goes stale.
+func WriteHeartbeat(path string, now time.Time) error {
+	if err := os.WriteFile(path, []byte(now.Format(time.RFC3339)+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing heartbeat file, %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// historyBucket holds the recorded runs keyed by start time
+var historyBucket = []byte("runs")
+
+// historyLockTimeout bounds waiting for another process holding the history
+// file, e.g. a cron run overlapping the daemon
+const historyLockTimeout = 5 * time.Second
+
+// History configures the local store of every run for auditing decisions
+type History struct {
+	Path   string
+	MaxAge time.Duration
+}
+
+// openHistory opens the BoltDB history file, creating it if needed.
+func openHistory(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: historyLockTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open history file %s, %s", path, err)
+	}
+	return db, nil
+}
+
+// historyKey orders the runs by start time; the action separates a start
+// and a stop run starting in the same nanosecond.
+func historyKey(summary RunSummary) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(summary.Timestamp.UnixNano()))
+	return append(key, summary.Action...)
+}
+
+// RecordHistory stores the run summary in the history file and drops runs
+// older than History.MaxAge when set.
+func RecordHistory(history History, summary RunSummary) error {
+	value, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("error encoding history entry, %s", err)
+	}
+
+	db, err := openHistory(history.Path, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(historyKey(summary), value); err != nil {
+			return err
+		}
+		if history.MaxAge <= 0 {
+			return nil
+		}
+		cutoff := binary.BigEndian.AppendUint64(nil, uint64(summary.Timestamp.Add(-history.MaxAge).UnixNano()))
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil && string(key) < string(cutoff); key, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PrintHistory writes the most recent runs in the history file, newest
+// first.
+func PrintHistory(path string, limit int, w io.Writer) error {
+	// A read-only open cannot create the file and fails obscurely without it
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("unable to read history file, %s", err)
+	}
+	db, err := openHistory(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tDEVICE\tACTION\tACT\tFIRED\tPAST\tFUTURE\tREASON_CODE\tREASON")
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		count := 0
+		for key, value := cursor.Last(); key != nil && (limit <= 0 || count < limit); key, value = cursor.Prev() {
+			var summary RunSummary
+			if err := json.Unmarshal(value, &summary); err != nil {
+				return fmt.Errorf("error decoding history entry, %s", err)
+			}
+			reason := summary.Reason
+			if summary.Error != "" {
+				reason = "error: " + summary.Error
+			}
+			if summary.DryRun {
+				reason = "(dry run) " + reason
+			}
+			device := summary.Device
+			if device == "" {
+				device = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%t\t%s\t%s\t%s\t%s\n",
+				summary.Timestamp.Local().Format(time.RFC3339), device, summary.Action, summary.Act, summary.WebhookFired,
+				strconv.FormatFloat(summary.PastPrecip, 'f', -1, 64), strconv.FormatFloat(summary.FuturePrecip, 'f', -1, 64),
+				summary.ReasonCode, reason)
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
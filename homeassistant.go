@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HomeAssistant holds the parameters for commanding the vacuum through the
+// Home Assistant REST API
+type HomeAssistant struct {
+	URL      string
+	Token    string
+	EntityID string
+}
+
+// Commands sent to Home Assistant
+const (
+	homeAssistantStart  = "start"
+	homeAssistantStop   = "stop"
+	homeAssistantReturn = "return"
+)
+
+// homeAssistantServices maps each command to the service of the entity's
+// domain; robot mowers use the lawn_mower domain rather than vacuum
+var homeAssistantServices = map[string]map[string]string{
+	"vacuum": {
+		homeAssistantStart:  "start",
+		homeAssistantStop:   "stop",
+		homeAssistantReturn: "return_to_base",
+	},
+	"lawn_mower": {
+		homeAssistantStart:  "start_mowing",
+		homeAssistantStop:   "pause",
+		homeAssistantReturn: "dock",
+	},
+}
+
+// homeAssistantService returns the service URL path for the command on the
+// entity, e.g. vacuum/return_to_base.
+func homeAssistantService(entityID string, command string) (string, error) {
+	domain, _, _ := strings.Cut(entityID, ".")
+	services, ok := homeAssistantServices[domain]
+	if !ok {
+		return "", fmt.Errorf("unsupported Home Assistant entity %s, expected a vacuum or lawn_mower entity", entityID)
+	}
+	return domain + "/" + services[command], nil
+}
+
+// CallHomeAssistant calls the service for the command on the configured
+// entity, once per vacuum ID when the entity ID is a template like the
+// webhook URLs. Every vacuum is attempted even if an earlier one fails.
+func CallHomeAssistant(config *Configuration, command string) (string, error) {
+	settings := config.Vacuum.HomeAssistant
+	entityIDs, err := WebhookURLs(config, settings.EntityID)
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: config.Vacuum.Timeout}
+	var responses []string
+	var failures []string
+	for _, entityID := range entityIDs {
+		response, err := callHomeAssistantService(client, settings, entityID, command)
+		if len(entityIDs) > 1 {
+			response = entityID + ": " + response
+		}
+		responses = append(responses, response)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", entityID, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return strings.Join(responses, "\n"), fmt.Errorf("home assistant service call failed for %s", strings.Join(failures, "; "))
+	}
+	return strings.Join(responses, "\n"), nil
+}
+
+// callHomeAssistantService POSTs the service call for a single entity and
+// returns the response body.
+func callHomeAssistantService(client *http.Client, settings HomeAssistant, entityID string, command string) (string, error) {
+	service, err := homeAssistantService(entityID, command)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string]string{"entity_id": entityID})
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimSuffix(settings.URL, "/") + "/api/services/" + service
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("unable to build home assistant request, %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+settings.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading home assistant response, %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return string(body), fmt.Errorf("home assistant returned status %d for %s", resp.StatusCode, service)
+	}
+	return string(body), nil
+}
+
+// validateHomeAssistant checks the API settings when the vacuum is commanded
+// through Home Assistant.
+func validateHomeAssistant(c *Configuration) error {
+	settings := c.Vacuum.HomeAssistant
+	if settings.URL == "" || settings.Token == "" || settings.EntityID == "" {
+		return fmt.Errorf("homeAssistant.url, homeAssistant.token and homeAssistant.entityId must be set when the vacuum protocol is homeassistant")
+	}
+	entityIDs, err := WebhookURLs(c, settings.EntityID)
+	if err != nil {
+		return err
+	}
+	for _, entityID := range entityIDs {
+		if _, err := homeAssistantService(entityID, homeAssistantStart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
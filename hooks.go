@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// HookEnvironment exposes the decision to hook commands as environment
+// variables, in addition to the environment of this process.
+func HookEnvironment(device string, action string, decision Decision, pastPrecip float64, futurePrecip float64) []string {
+	return append(os.Environ(),
+		"ROBOVAC_DEVICE="+device,
+		"ROBOVAC_ACTION="+action,
+		"ROBOVAC_ACT="+strconv.FormatBool(decision.Act),
+		"ROBOVAC_REASON="+decision.Reason,
+		"ROBOVAC_REASON_CODE="+decision.Code,
+		"ROBOVAC_PAST_PRECIP="+strconv.FormatFloat(pastPrecip, 'f', -1, 64),
+		"ROBOVAC_FUTURE_PRECIP="+strconv.FormatFloat(futurePrecip, 'f', -1, 64),
+	)
+}
+
+// RunHook executes a hook command, given as the program followed by its
+// arguments, and fails if it exits non-zero. An empty command is a no-op.
+func RunHook(command []string, env []string) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed, %s: %s", command[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,1058 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	influx "github.com/influxdata/influxdb-client-go/v2"
+	influxAPI "github.com/influxdata/influxdb-client-go/v2/api"
+	influxHTTP "github.com/influxdata/influxdb-client-go/v2/api/http"
+	influxQuery "github.com/influxdata/influxdb-client-go/v2/api/query"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxSource reads precipitation maxima from InfluxDB using Flux
+type InfluxSource struct {
+	config      *Configuration
+	client      influx.Client
+	queryAPI    influxAPI.QueryAPI
+	bucket      string
+	buckets     []string
+	connections map[string]*influxConnection
+}
+
+// influxConnection is a named InfluxDB client along with the bucket it queries
+type influxConnection struct {
+	client   influx.Client
+	queryAPI influxAPI.QueryAPI
+	bucket   string
+}
+
+// NewInfluxSource connects to InfluxDB and resolves the bucket to query.
+// Precipitation is read from the influxDB section unless Query.Connection
+// names one of the additional connections, which are all connected here too.
+func NewInfluxSource(config *Configuration) (*InfluxSource, error) {
+	db := config.InfluxDB
+	if config.Query.Connection != "" {
+		named, ok := config.Connections[strings.ToLower(config.Query.Connection)]
+		if !ok {
+			return nil, fmt.Errorf("unknown InfluxDB connection %s", config.Query.Connection)
+		}
+		db = named
+	}
+
+	var bucket string
+	if len(db.Buckets) == 0 {
+		var err error
+		if bucket, err = influxBucket(db); err != nil {
+			return nil, err
+		}
+	}
+
+	client, queryAPI, err := InfluxConnect(db, config.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate to InfluxDB, %s", err)
+	}
+
+	source := &InfluxSource{
+		config:   config,
+		client:   client,
+		queryAPI: queryAPI,
+		bucket:   bucket,
+		buckets:  db.Buckets,
+	}
+
+	source.connections, err = influxConnections(config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if err := source.Refresh(context.Background()); err != nil {
+		source.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+// Refresh resolves what depends on the data currently stored: the freshest
+// of several buckets and the nearest forecast point. It runs when the source
+// is set up, and the daemon calls it again before every evaluation since its
+// source is reused.
+func (s *InfluxSource) Refresh(ctx context.Context) error {
+	if len(s.buckets) > 0 {
+		bucket, err := s.freshestBucket(ctx, s.buckets)
+		if err != nil {
+			return err
+		}
+		s.bucket = bucket
+	}
+
+	if s.config.Query.Location.LatitudeTag != "" {
+		// Resolve afresh each run since the stored points may change
+		s.config.Query.nearest = nil
+		nearest, distance, err := s.NearestPoint(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find the nearest forecast point, %w", err)
+		}
+		s.config.Query.nearest = nearest
+		log.WithFields(log.Fields{
+			"op":         "Refresh",
+			"latitude":   nearest.latitude,
+			"longitude":  nearest.longitude,
+			"distanceKm": distance,
+		}).Debug("selected nearest forecast point")
+	}
+	return nil
+}
+
+// influxBucket resolves the bucket of an InfluxDB connection, which for v1 is
+// the database and retention policy.
+func influxBucket(db InfluxDB) (string, error) {
+	switch {
+	case db.Bucket != "":
+		return db.Bucket, nil
+	case db.Database != "" && db.RetentionPolicy != "":
+		return fmt.Sprintf("%s/%s", db.Database, db.RetentionPolicy), nil
+	}
+	return "", fmt.Errorf("must configure at least one of bucket or database/retention policy")
+}
+
+// influxConnections connects to each of the named InfluxDB connections.
+func influxConnections(config *Configuration) (map[string]*influxConnection, error) {
+	connections := make(map[string]*influxConnection, len(config.Connections))
+	for name, db := range config.Connections {
+		bucket, err := influxBucket(db)
+		if err == nil {
+			connections[name] = &influxConnection{bucket: bucket}
+			connections[name].client, connections[name].queryAPI, err = InfluxConnect(db, config.HTTP)
+		}
+		if err != nil {
+			for _, connection := range connections {
+				if connection.client != nil {
+					connection.client.Close()
+				}
+			}
+			return nil, fmt.Errorf("failed to set up InfluxDB connection %s, %s", name, err)
+		}
+	}
+	return connections, nil
+}
+
+// connection returns the named InfluxDB connection, or the precipitation
+// connection when the name is empty.
+func (s *InfluxSource) connection(name string) (*influxConnection, error) {
+	if name == "" {
+		return &influxConnection{client: s.client, queryAPI: s.queryAPI, bucket: s.bucket}, nil
+	}
+	connection, ok := s.connections[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown InfluxDB connection %s", name)
+	}
+	return connection, nil
+}
+
+// freshestBucket returns the configured bucket holding the most recent
+// precipitation point, so that redundant buckets with mixed freshness can
+// back each other up.
+func (s *InfluxSource) freshestBucket(ctx context.Context, buckets []string) (string, error) {
+	var freshest string
+	var newest time.Time
+	for _, bucket := range buckets {
+		result, err := s.queryAPI.Query(ctx, NewestPointQuery(s.config, bucket))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"op":     "freshestBucket",
+				"bucket": bucket,
+				"error":  err,
+			}).Warn("failed to query bucket freshness")
+			continue
+		}
+		if result.Next() && result.Record().Time().After(newest) {
+			newest = result.Record().Time()
+			freshest = bucket
+		}
+		result.Close()
+	}
+
+	if freshest == "" {
+		return "", fmt.Errorf("no data found in any of the configured buckets")
+	}
+	log.WithFields(log.Fields{
+		"op":     "freshestBucket",
+		"bucket": freshest,
+		"newest": newest,
+	}).Debug("selected freshest bucket")
+	return freshest, nil
+}
+
+// Lookback returns the maximum precipitation over the lookback window.
+func (s *InfluxSource) Lookback(ctx context.Context, threshold float64) (float64, error) {
+	query, err := LookbackQuery(s.config, s.bucket)
+	if err != nil {
+		return 0, err
+	}
+	return s.queryPrecip(ctx, query, threshold)
+}
+
+// Lookforward returns the maximum precipitation over the lookforward window.
+func (s *InfluxSource) Lookforward(ctx context.Context, threshold float64) (float64, error) {
+	query, err := LookforwardQuery(s.config, s.bucket)
+	if err != nil {
+		return 0, err
+	}
+	return s.queryPrecip(ctx, query, threshold)
+}
+
+// Close releases the InfluxDB clients.
+func (s *InfluxSource) Close() {
+	s.client.Close()
+	for _, connection := range s.connections {
+		connection.client.Close()
+	}
+}
+
+// ForecastMin returns the minimum of the given series over the lookforward
+// window, read through the named connection. The measurement defaults to the
+// precipitation measurement.
+func (s *InfluxSource) ForecastMin(ctx context.Context, connection string, measurement string, field string) (float64, error) {
+	if measurement == "" {
+		measurement = s.config.InfluxDB.Measurement
+	}
+	conn, err := s.connection(connection)
+	if err != nil {
+		return 0, err
+	}
+	return queryFloat(ctx, conn.queryAPI, ForecastMinQuery(s.config, conn.bucket, measurement, field))
+}
+
+// ProbabilityMax returns the highest probability of precipitation over the
+// lookforward window, read from the series set in Probability.
+func (s *InfluxSource) ProbabilityMax(ctx context.Context) (float64, error) {
+	measurement := s.config.Probability.Measurement
+	if measurement == "" {
+		measurement = s.config.InfluxDB.Measurement
+	}
+	conn, err := s.connection(s.config.Probability.Connection)
+	if err != nil {
+		return 0, err
+	}
+	return queryFloat(ctx, conn.queryAPI, ForecastMaxQuery(s.config, conn.bucket, measurement, s.config.Probability.Field))
+}
+
+// LatestValue returns the most recent value of the given series written
+// within the given duration, read through the named connection. Tag filters
+// do not apply since the series typically describes the vacuum rather than
+// the weather.
+func (s *InfluxSource) LatestValue(ctx context.Context, connection string, measurement string, field string, within time.Duration) (interface{}, error) {
+	conn, err := s.connection(connection)
+	if err != nil {
+		return nil, err
+	}
+	result, err := conn.queryAPI.Query(ctx, LatestValueQuery(conn.bucket, measurement, field, within))
+	if err != nil {
+		return nil, queryError(err)
+	}
+	defer result.Close()
+
+	if !result.Next() {
+		if result.Err() != nil {
+			return nil, fmt.Errorf("failed parsing data from InfluxDB, %s", result.Err())
+		}
+		return nil, ErrNoData
+	}
+	return result.Record().Value(), nil
+}
+
+// ObservedMax returns the maximum of the observed precipitation series over
+// the lookback window.
+func (s *InfluxSource) ObservedMax(ctx context.Context) (float64, error) {
+	conn, err := s.connection(s.config.Observed.Connection)
+	if err != nil {
+		return 0, err
+	}
+	return queryFloat(ctx, conn.queryAPI, ObservedMaxQuery(s.config, conn.bucket))
+}
+
+// ConditionValues returns the value of each of Query.Conditions over its
+// window, in order.
+func (s *InfluxSource) ConditionValues(ctx context.Context) ([]float64, error) {
+	values := make([]float64, len(s.config.Query.Conditions))
+	for i, condition := range s.config.Query.Conditions {
+		conn, err := s.connection(condition.Connection)
+		if err != nil {
+			return nil, err
+		}
+		values[i], err = queryFloat(ctx, conn.queryAPI, ConditionQuery(s.config, conn.bucket, condition))
+		if err != nil {
+			return nil, fmt.Errorf("condition %s, %w", condition.Name, err)
+		}
+	}
+	return values, nil
+}
+
+// DewPointSpread returns the smallest difference between the forecast
+// temperature and dew point over the lookforward window.
+func (s *InfluxSource) DewPointSpread(ctx context.Context) (float64, error) {
+	conn, err := s.connection(s.config.Dew.Connection)
+	if err != nil {
+		return 0, err
+	}
+	return queryFloat(ctx, conn.queryAPI, DewPointSpreadQuery(s.config, conn.bucket))
+}
+
+// MinutesSinceRain returns how many minutes ago the last precipitation above
+// the threshold fell, looking back Query.MinDrySince. ErrNoData means it has
+// been dry for at least that long.
+func (s *InfluxSource) MinutesSinceRain(ctx context.Context, threshold float64) (float64, error) {
+	query, err := MinutesSinceRainQuery(s.config, s.bucket, threshold)
+	if err != nil {
+		return 0, err
+	}
+	return queryFloat(ctx, s.queryAPI, query)
+}
+
+// FirstWet returns the time of the earliest point in the lookforward window
+// with precipitation above the threshold.
+func (s *InfluxSource) FirstWet(ctx context.Context, threshold float64) (time.Time, error) {
+	result, err := s.queryAPI.Query(ctx, FirstWetQuery(s.config, s.bucket, threshold))
+	if err != nil {
+		return time.Time{}, queryError(err)
+	}
+	defer result.Close()
+
+	if !result.Next() {
+		if result.Err() != nil {
+			return time.Time{}, fmt.Errorf("failed parsing data from InfluxDB, %s", result.Err())
+		}
+		return time.Time{}, ErrNoData
+	}
+	return result.Record().Time(), nil
+}
+
+// ExpectedDryWindow returns how long the forecast is expected to stay dry:
+// the time until the first point above the threshold in the lookforward
+// window, or until the end of the window when none is forecast.
+func (s *InfluxSource) ExpectedDryWindow(ctx context.Context, threshold float64) (time.Duration, error) {
+	firstWet, err := s.FirstWet(ctx, threshold)
+	if errors.Is(err, ErrNoData) {
+		offset, err := ParseFluxDuration(s.config.Query.LookforwardOffset)
+		if err != nil {
+			return 0, err
+		}
+		duration, err := ParseFluxDuration(s.config.Query.LookforwardDuration)
+		if err != nil {
+			return 0, err
+		}
+		return offset + duration, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return max(time.Until(firstWet), 0), nil
+}
+
+// DailyMax returns the maximum precipitation of each of the last
+// Query.DryDaysWindow calendar days (UTC), including today. Days without data
+// are omitted.
+func (s *InfluxSource) DailyMax(ctx context.Context) ([]float64, error) {
+	result, err := s.queryAPI.Query(ctx, DryDaysQuery(s.config, s.bucket))
+	if err != nil {
+		return nil, queryError(err)
+	}
+	defer result.Close()
+
+	column := valueColumn(s.config.Query)
+	var daily []float64
+	for result.Next() {
+		value, ok := toFloat(result.Record().ValueByKey(column))
+		if !ok {
+			return nil, fmt.Errorf("unexpected value %v returned from InfluxDB", result.Record().ValueByKey(column))
+		}
+		daily = append(daily, value)
+	}
+	if result.Err() != nil {
+		return nil, fmt.Errorf("failed parsing data from InfluxDB, %s", result.Err())
+	}
+	return daily, nil
+}
+
+// queryError wraps a failed query. Client errors other than timeouts and rate
+// limiting mean the query itself is wrong, so they are marked as not
+// retryable; server and connection errors may be transient.
+func queryError(err error) error {
+	var httpErr *influxHTTP.Error
+	if errors.As(err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 &&
+		httpErr.StatusCode != http.StatusRequestTimeout && httpErr.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("failed to query InfluxDB (%w, status %d), %s", ErrNotRetryable, httpErr.StatusCode, err)
+	}
+	return fmt.Errorf("failed to query InfluxDB, %s", err)
+}
+
+// toFloat converts a numeric Flux value to a float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// queryFloat runs a Flux query returning a single float value.
+func queryFloat(ctx context.Context, queryAPI influxAPI.QueryAPI, query string) (float64, error) {
+	result, err := queryAPI.Query(ctx, query)
+	if err != nil {
+		return 0, queryError(err)
+	}
+	defer result.Close()
+
+	if !result.Next() {
+		if result.Err() != nil {
+			return 0, fmt.Errorf("failed parsing data from InfluxDB, %s", result.Err())
+		}
+		return 0, ErrNoData
+	}
+	value, ok := result.Record().Value().(float64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected value %v returned from InfluxDB", result.Record().Value())
+	}
+	return value, nil
+}
+
+// queryPrecip runs a Flux query returning a single aggregated value. When
+// per-tag thresholds are configured the query returns one value per tag and
+// each tag is judged wet or dry against its own threshold, or against
+// threshold, the one the window is decided on, when it has none. Dry tags do
+// not contribute, so all series being dry yields zero, while a wet tag is
+// reported at least just above threshold so that the decision cannot count
+// it dry.
+func (s *InfluxSource) queryPrecip(ctx context.Context, query string, threshold float64) (float64, error) {
+	result, err := s.queryAPI.Query(ctx, query)
+	if err != nil {
+		return 0, queryError(err)
+	}
+	defer result.Close()
+
+	if len(s.config.Query.PerTagThresholds) == 0 {
+		return s.singleFieldPrecip(result)
+	}
+
+	var precip float64
+	var rows int
+	for result.Next() {
+		value, err := s.recordPrecip(result.Record())
+		if err != nil {
+			return 0, err
+		}
+		tag := fmt.Sprint(result.Record().ValueByKey(s.config.Query.TagKey))
+		if value > TagThreshold(s.config.Query, tag, threshold) {
+			precip = max(precip, value, math.Nextafter(threshold, math.Inf(1)))
+		}
+		rows++
+	}
+	if result.Err() != nil {
+		return 0, fmt.Errorf("failed parsing data from InfluxDB, %s", result.Err())
+	}
+	if rows == 0 {
+		return 0, ErrNoData
+	}
+	return precip, nil
+}
+
+// singleFieldPrecip reads the value of an aggregated query result. The
+// aggregation runs once per series, e.g. per station or bucket, so the
+// highest value of them is used regardless of the order of the tables. A
+// result spanning several fields points at a filter that is too loose, so it
+// is handled according to Query.MultipleFieldsPolicy.
+func (s *InfluxSource) singleFieldPrecip(result *influxAPI.QueryTableResult) (float64, error) {
+	var highest float64
+	fields := make(map[string]bool)
+	for rows := 0; result.Next(); rows++ {
+		value, err := s.recordPrecip(result.Record())
+		if err != nil {
+			return 0, err
+		}
+		if rows == 0 {
+			highest = value
+		} else {
+			highest = max(highest, value)
+		}
+		fields[result.Record().Field()] = true
+	}
+	if result.Err() != nil {
+		return 0, fmt.Errorf("failed parsing data from InfluxDB, %s", result.Err())
+	}
+	if len(fields) == 0 {
+		return 0, ErrNoData
+	}
+	if len(fields) == 1 {
+		return highest, nil
+	}
+
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	if s.config.Query.MultipleFieldsPolicy != MultipleFieldsMax {
+		return 0, fmt.Errorf("query returned multiple fields (%s), tighten the field filter", strings.Join(names, ", "))
+	}
+	log.WithFields(log.Fields{
+		"op":     "singleFieldPrecip",
+		"fields": names,
+	}).Warn("query returned multiple fields, using the maximum")
+	return highest, nil
+}
+
+// recordPrecip extracts the precipitation value from an aggregated record.
+// When wet intervals are being counted the record instead holds the
+// accumulation and the number of wet intervals, which are reduced to a
+// single value.
+func (s *InfluxSource) recordPrecip(record *influxQuery.FluxRecord) (float64, error) {
+	if s.config.Query.WetInterval == "" {
+		value, ok := record.ValueByKey(valueColumn(s.config.Query)).(float64)
+		if !ok {
+			return 0, fmt.Errorf("unexpected value %v returned from InfluxDB", record.ValueByKey(valueColumn(s.config.Query)))
+		}
+		return value, nil
+	}
+
+	total, ok := record.ValueByKey("total").(float64)
+	if !ok {
+		return 0, fmt.Errorf("InfluxDB result is missing the accumulated total")
+	}
+	wet, ok := record.ValueByKey("wet").(int64)
+	if !ok {
+		return 0, fmt.Errorf("InfluxDB result is missing the wet interval count")
+	}
+	return SignificantPrecip(s.config.Query, total, wet)
+}
+
+// TagThreshold returns the precipitation threshold for a series with the
+// given tag value, falling back to the given threshold for unlisted tags.
+// Tag values are matched case-insensitively since configuration keys are
+// lowercased when loaded.
+func TagThreshold(q Query, tag string, fallback float64) float64 {
+	if threshold, ok := q.PerTagThresholds[strings.ToLower(tag)]; ok {
+		return threshold
+	}
+	return fallback
+}
+
+// v1CompatOrganization is the placeholder organization sent to the InfluxDB
+// 1.8+ compatibility API, which ignores it but rejects an empty value
+const v1CompatOrganization = "-"
+
+// InfluxConnect establishes an InfluxDB client. Without a token the v1
+// compatibility API is assumed and the organization may be left empty.
+func InfluxConnect(db InfluxDB, retry HTTP) (influx.Client, influxAPI.QueryAPI, error) {
+	var auth string
+	if db.Token != "" {
+		auth = db.Token
+	} else if db.Username != "" && db.Password != "" {
+		auth = fmt.Sprintf("%s:%s", db.Username, db.Password)
+	} else {
+		auth = ""
+	}
+
+	options := influx.DefaultOptions().
+		SetTLSConfig(&tls.Config{
+			InsecureSkipVerify: db.SkipVerifySsl,
+		})
+	if db.Timeout > 0 {
+		// The client only takes whole seconds; round up so a sub-second
+		// timeout does not become no timeout at all
+		options.SetHTTPRequestTimeout(uint((db.Timeout + time.Second - 1) / time.Second))
+	}
+	httpClient := options.HTTPClient()
+	httpClient.Transport = withRetries(&headerTransport{
+		base:    httpClient.Transport,
+		headers: db.Headers,
+	}, retry)
+	client := influx.NewClientWithOptions(db.Address, auth, options)
+
+	organization := db.Organization
+	if organization == "" {
+		if db.Token != "" {
+			client.Close()
+			return nil, nil, fmt.Errorf("organization must be set when authenticating with a token")
+		}
+		organization = v1CompatOrganization
+	}
+	queryAPI := client.QueryAPI(organization)
+
+	if db.HealthCheckAttempts > 0 {
+		if err := waitHealthy(client, db); err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+	}
+
+	return client, queryAPI, nil
+}
+
+// defaultHealthCheckDelay is the wait between health checks when
+// HealthCheckDelay is unset
+const defaultHealthCheckDelay = 5 * time.Second
+
+// waitHealthy pings InfluxDB up to HealthCheckAttempts times, waiting
+// HealthCheckDelay in between, so that a momentarily busy server does not fail
+// the run.
+func waitHealthy(client influx.Client, db InfluxDB) error {
+	delay := db.HealthCheckDelay
+	if delay <= 0 {
+		delay = defaultHealthCheckDelay
+	}
+
+	var err error
+	for attempt := 1; attempt <= db.HealthCheckAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+		}
+		if _, err = client.Ping(context.Background()); err == nil {
+			return nil
+		}
+		log.WithFields(log.Fields{
+			"op":       "waitHealthy",
+			"address":  db.Address,
+			"attempt":  attempt,
+			"attempts": db.HealthCheckAttempts,
+			"error":    err,
+		}).Warn("InfluxDB health check failed")
+	}
+	return fmt.Errorf("InfluxDB at %s did not pass the health check, %s", db.Address, err)
+}
+
+// headerTransport adds a fixed set of headers to every request, e.g. for auth
+// proxies sitting in front of InfluxDB, along with the current correlation ID
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+// RoundTrip sets the configured headers on a copy of the request before
+// passing it to the underlying transport.
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	if id := CorrelationID(); id != "" {
+		req.Header.Set(correlationHeader, id)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// LookbackQuery builds the Flux query for the maximum precipitation over the
+// lookback window, or renders Query.LookbackFluxFile when set.
+func LookbackQuery(config *Configuration, bucket string) (string, error) {
+	if config.Query.LookbackFluxFile != "" {
+		data := fluxTemplateData(config, bucket)
+		data.Range = lookbackRange(config.Query)
+		data.Start = lookbackStart(config.Query)
+		data.Stop = fluxNow(config.Query)
+		return RenderFluxFile(config.Query.LookbackFluxFile, data)
+	}
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s%s%s`,
+		fluxImports(config.Query), fluxString(bucket), lookbackRange(config.Query),
+		fluxString(config.InfluxDB.Measurement), fluxString(config.InfluxDB.Field), tagFilters(config.Query),
+		sampling(config.Query, config.Query.LookbackDuration), aggregation(config.Query)), nil
+}
+
+// LookforwardQuery builds the Flux query for the maximum precipitation over
+// the lookforward window, or renders Query.LookforwardFluxFile when set. With
+// Query.IssueTimeTag only the most recently issued forecast run is considered.
+func LookforwardQuery(config *Configuration, bucket string) (string, error) {
+	if config.Query.LookforwardFluxFile != "" {
+		data := fluxTemplateData(config, bucket)
+		data.Range = lookforwardRange(config.Query)
+		data.Start = lookforwardStart(config.Query)
+		data.Stop = lookforwardStop(config.Query)
+		return RenderFluxFile(config.Query.LookforwardFluxFile, data)
+	}
+	if config.Query.IssueTimeTag != "" {
+		tag := fluxString(config.Query.IssueTimeTag)
+		return fmt.Sprintf(`%s
+		data = from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s
+		issue = (data
+			|> group()
+			|> sort(columns: [%s], desc: true)
+			|> limit(n: 1)
+			|> findRecord(fn: (key) => true, idx: 0))[%s]
+		data
+			|> filter(fn: (r) => r[%s] == issue)%s%s`,
+			fluxImports(config.Query), fluxString(bucket), lookforwardRange(config.Query),
+			fluxString(config.InfluxDB.Measurement), fluxString(config.InfluxDB.Field), tagFilters(config.Query),
+			tag, tag, tag, sampling(config.Query, config.Query.LookforwardDuration), aggregation(config.Query)), nil
+	}
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s%s%s`,
+		fluxImports(config.Query), fluxString(bucket), lookforwardRange(config.Query),
+		fluxString(config.InfluxDB.Measurement), fluxString(config.InfluxDB.Field), tagFilters(config.Query),
+		sampling(config.Query, config.Query.LookforwardDuration), aggregation(config.Query)), nil
+}
+
+// ForecastMinQuery builds the Flux query for the minimum of another series
+// over the lookforward window, across every matching series.
+func ForecastMinQuery(config *Configuration, bucket string, measurement string, field string) string {
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s
+			|> group()
+			|> min(column: "_value")`,
+		fluxImports(config.Query), fluxString(bucket), lookforwardRange(config.Query),
+		fluxString(measurement), fluxString(field), tagFilters(config.Query))
+}
+
+// ForecastMaxQuery builds the Flux query for the maximum of another series
+// over the lookforward window, across every matching series.
+func ForecastMaxQuery(config *Configuration, bucket string, measurement string, field string) string {
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s
+			|> group()
+			|> max(column: "_value")`,
+		fluxImports(config.Query), fluxString(bucket), lookforwardRange(config.Query),
+		fluxString(measurement), fluxString(field), tagFilters(config.Query))
+}
+
+// LatestValueQuery builds the Flux query for the last value of a series
+// written within the given duration.
+func LatestValueQuery(bucket string, measurement string, field string, within time.Duration) string {
+	return fmt.Sprintf(`from(bucket: %s)
+			|> range(start: -%ds)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)
+			|> last()`,
+		fluxString(bucket), int64(within.Seconds()), fluxString(measurement), fluxString(field))
+}
+
+// NewestPointQuery builds the Flux query for the timestamp of the most recent
+// precipitation point in a bucket, spanning the lookback and lookforward
+// windows.
+func NewestPointQuery(config *Configuration, bucket string) string {
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(start: %s, stop: %s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s
+			|> last()
+			|> group()
+			|> sort(columns: ["_time"], desc: true)
+			|> limit(n: 1)`,
+		fluxImports(config.Query), fluxString(bucket), lookbackStart(config.Query), lookforwardStop(config.Query),
+		fluxString(config.InfluxDB.Measurement), fluxString(config.InfluxDB.Field), tagFilters(config.Query))
+}
+
+// NearestPointQuery builds the Flux query listing the coordinate tags of
+// every forecast series with data in the lookback or lookforward window.
+func NearestPointQuery(config *Configuration, bucket string) string {
+	location := config.Query.Location
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(start: %s, stop: %s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s
+			|> last()
+			|> keep(columns: [%s, %s])
+			|> group()`,
+		fluxImports(config.Query), fluxString(bucket), lookbackStart(config.Query), lookforwardStop(config.Query),
+		fluxString(config.InfluxDB.Measurement), fluxString(config.InfluxDB.Field), tagFilters(config.Query),
+		fluxString(location.LatitudeTag), fluxString(location.LongitudeTag))
+}
+
+// ObservedMaxQuery builds the Flux query for the maximum of the observed
+// precipitation series over the lookback window. Tag filters do not apply
+// since they describe the forecast series.
+func ObservedMaxQuery(config *Configuration, bucket string) string {
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)
+			|> group()
+			|> max(column: "_value")`,
+		fluxImports(config.Query), fluxString(bucket), lookbackRange(config.Query),
+		fluxString(config.Observed.Measurement), fluxString(config.Observed.Field))
+}
+
+// ConditionQuery builds the Flux query reducing a condition's series over its
+// window, the lookforward window by default. Tag filters do not apply since
+// they describe the precipitation series.
+func ConditionQuery(config *Configuration, bucket string, condition Condition) string {
+	window := lookforwardRange(config.Query)
+	if condition.Window == ConditionWindowLookback {
+		window = lookbackRange(config.Query)
+	}
+	reduce := `max(column: "_value")`
+	switch condition.Aggregation {
+	case "min", "mean":
+		reduce = fmt.Sprintf(`%s(column: "_value")`, condition.Aggregation)
+	case "last":
+		reduce = `sort(columns: ["_time"])
+			|> last()`
+	}
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)
+			|> group()
+			|> %s`,
+		fluxImports(config.Query), fluxString(bucket), window,
+		fluxString(condition.Measurement), fluxString(condition.Field), reduce)
+}
+
+// DewPointSpreadQuery builds the Flux query for the minimum difference
+// between the temperature and dew point over the lookforward window.
+func DewPointSpreadQuery(config *Configuration, bucket string) string {
+	measurement := config.Dew.Measurement
+	if measurement == "" {
+		measurement = config.InfluxDB.Measurement
+	}
+	temperature := fluxString(config.Dew.TemperatureField)
+	dewPoint := fluxString(config.Dew.DewPointField)
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and (r["_field"] == %s or r["_field"] == %s))%s
+			|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+			|> filter(fn: (r) => exists r[%s] and exists r[%s])
+			|> map(fn: (r) => ({r with _value: r[%s] - r[%s]}))
+			|> group()
+			|> min(column: "_value")`,
+		fluxImports(config.Query), fluxString(bucket), lookforwardRange(config.Query),
+		fluxString(measurement), temperature, dewPoint, tagFilters(config.Query),
+		temperature, dewPoint, temperature, dewPoint)
+}
+
+// MinutesSinceRainQuery builds the Flux query for the minutes elapsed since
+// the last point with precipitation above the threshold within
+// Query.MinDrySince.
+func MinutesSinceRainQuery(config *Configuration, bucket string, threshold float64) (string, error) {
+	within, err := ParseFluxDuration(config.Query.MinDrySince)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`from(bucket: %s)
+			|> range(start: -%ds)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s
+			|> filter(fn: (r) => r[%s] > %s)
+			|> group()
+			|> sort(columns: ["_time"])
+			|> last(column: "_time")
+			|> map(fn: (r) => ({r with _value: float(v: int(v: now()) - int(v: r._time)) / 60000000000.0}))`,
+		fluxString(bucket), int64(within.Seconds()),
+		fluxString(config.InfluxDB.Measurement), fluxString(config.InfluxDB.Field), tagFilters(config.Query),
+		fluxString(valueColumn(config.Query)), fluxFloat(threshold)), nil
+}
+
+// FirstWetQuery builds the Flux query for the earliest point with
+// precipitation above the threshold in the lookforward window.
+func FirstWetQuery(config *Configuration, bucket string, threshold float64) string {
+	return fmt.Sprintf(`%s
+		from(bucket: %s)
+			|> range(%s)
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s
+			|> filter(fn: (r) => r[%s] > %s)
+			|> group()
+			|> sort(columns: ["_time"])
+			|> limit(n: 1)`,
+		fluxImports(config.Query), fluxString(bucket), lookforwardRange(config.Query),
+		fluxString(config.InfluxDB.Measurement), fluxString(config.InfluxDB.Field), tagFilters(config.Query),
+		fluxString(valueColumn(config.Query)), fluxFloat(threshold))
+}
+
+// DryDaysQuery builds the Flux query for the maximum precipitation of each
+// calendar day in the dry-days window.
+func DryDaysQuery(config *Configuration, bucket string) string {
+	column := fluxString(valueColumn(config.Query))
+	return fmt.Sprintf(`import "date"
+		import "experimental"
+		from(bucket: %s)
+			|> range(start: experimental.subDuration(d: %dd, from: date.truncate(t: now(), unit: 1d)))
+			|> filter(fn: (r) => r["_measurement"] == %s and r["_field"] == %s)%s
+			|> group()
+			|> aggregateWindow(every: 1d, fn: max, column: %s, createEmpty: false)`,
+		fluxString(bucket), config.Query.DryDaysWindow-1,
+		fluxString(config.InfluxDB.Measurement), fluxString(config.InfluxDB.Field), tagFilters(config.Query), column)
+}
+
+// fluxImports returns the package imports needed by the range helpers.
+func fluxImports(query Query) string {
+	if query.TruncateNow != "" {
+		return `import "date"
+		import "experimental"`
+	}
+	return `import "experimental"`
+}
+
+// fluxNow returns the Flux expression for the current time, rounded down to
+// TruncateNow when set so that consecutive runs evaluate identical windows.
+func fluxNow(query Query) string {
+	if query.TruncateNow != "" {
+		return fmt.Sprintf("date.truncate(t: now(), unit: %s)", query.TruncateNow)
+	}
+	return "now()"
+}
+
+// lookbackRange builds the Flux range parameters for the lookback window.
+func lookbackRange(query Query) string {
+	if query.TruncateNow != "" {
+		return fmt.Sprintf("start: %s, stop: %s", lookbackStart(query), fluxNow(query))
+	}
+	return fmt.Sprintf("start: %s", lookbackStart(query))
+}
+
+// lookbackStart returns the Flux expression for the start of the lookback
+// window.
+func lookbackStart(query Query) string {
+	if query.TruncateNow != "" {
+		return fmt.Sprintf("experimental.subDuration(d: %s, from: %s)", query.LookbackDuration, fluxNow(query))
+	}
+	return "-" + query.LookbackDuration
+}
+
+// lookforwardRange builds the Flux range parameters for the lookforward
+// window.
+func lookforwardRange(query Query) string {
+	return fmt.Sprintf("start: %s, stop: %s", lookforwardStart(query), lookforwardStop(query))
+}
+
+// lookforwardStart returns the Flux expression for the start of the
+// lookforward window. The window starts LookforwardOffset after now so that
+// deployment time can be accounted for.
+func lookforwardStart(query Query) string {
+	start := fluxNow(query)
+	if query.LookforwardOffset != "" {
+		start = fmt.Sprintf("experimental.addDuration(d: %s, to: %s)", query.LookforwardOffset, start)
+	}
+	return start
+}
+
+// lookforwardStop returns the Flux expression for the end of the lookforward
+// window.
+func lookforwardStop(query Query) string {
+	return fmt.Sprintf("experimental.addDuration(d: %s, to: %s)", query.LookforwardDuration, lookforwardStart(query))
+}
+
+// aggregation builds the final Flux steps reducing the window to a value.
+// By default this is the maximum; when WetInterval is set the data is summed
+// per interval and reduced to the total accumulation and the number of
+// intervals in which precipitation fell. With per-tag thresholds the data is
+// first grouped by the tag so each tag is reduced separately, and with
+// WindowEvery it is downsampled to the mean of each window to smooth out
+// single-point spikes.
+func aggregation(query Query) string {
+	column := fluxString(valueColumn(query))
+	var group string
+	if len(query.PerTagThresholds) > 0 {
+		group = fmt.Sprintf(`
+			|> group(columns: [%s])`, fluxString(query.TagKey))
+	}
+	if query.WindowEvery != "" {
+		group += fmt.Sprintf(`
+			|> aggregateWindow(every: %s, fn: mean, column: %s, createEmpty: false)`, query.WindowEvery, column)
+	}
+	if query.WetInterval == "" {
+		return group + fmt.Sprintf(`
+			|> max(column: %s)`, column)
+	}
+	return group + fmt.Sprintf(`
+			|> aggregateWindow(every: %s, fn: sum, column: %s, createEmpty: false)
+			|> reduce(
+				identity: {total: 0.0, wet: 0},
+				fn: (r, accumulator) => ({
+					total: accumulator.total + r[%s],
+					wet: if r[%s] > 0.0 then accumulator.wet + 1 else accumulator.wet,
+				}),
+			)`, query.WetInterval, column, column, column)
+}
+
+// sampling builds the Flux step keeping every SampleEvery-th point of a
+// window, applied only once the window is at least SampleMinWindow long.
+func sampling(query Query, window string) string {
+	if query.SampleEvery <= 1 {
+		return ""
+	}
+	if query.SampleMinWindow != "" {
+		length, err := ParseFluxDuration(window)
+		if err != nil {
+			return ""
+		}
+		minimum, err := ParseFluxDuration(query.SampleMinWindow)
+		if err != nil || length < minimum {
+			return ""
+		}
+	}
+	return fmt.Sprintf(`
+			|> sample(n: %d)`, query.SampleEvery)
+}
+
+// valueColumn returns the column holding the precipitation values.
+func valueColumn(query Query) string {
+	if query.ValueColumn == "" {
+		return "_value"
+	}
+	return query.ValueColumn
+}
+
+// tagFilters builds the additional Flux filter steps restricting the series
+// to the allowed tag values and dropping the excluded ones, and to the nearest
+// point of Query.Location once resolved.
+func tagFilters(query Query) string {
+	filters := locationFilter(query)
+	if len(query.IncludeTagValues) > 0 {
+		filters += fmt.Sprintf(`
+			|> filter(fn: (r) => %s)`, tagConditions(query.TagKey, query.IncludeTagValues))
+	}
+	if len(query.ExcludeTagValues) > 0 {
+		filters += fmt.Sprintf(`
+			|> filter(fn: (r) => not (%s))`, tagConditions(query.TagKey, query.ExcludeTagValues))
+	}
+	return filters
+}
+
+// tagConditions joins an equality check for each value with or.
+func tagConditions(key string, values []string) string {
+	conditions := make([]string, len(values))
+	for i, value := range values {
+		conditions[i] = fmt.Sprintf(`r[%s] == %s`, fluxString(key), fluxString(value))
+	}
+	return strings.Join(conditions, " or ")
+}
+
+// fluxStringEscaper escapes the characters with special meaning inside a Flux
+// string literal, including the ${ interpolation sequence
+var fluxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`)
+
+// fluxFloat formats a value as a Flux float literal, which needs a decimal
+// point to compare against float fields.
+func fluxFloat(value float64) string {
+	literal := strconv.FormatFloat(value, 'f', -1, 64)
+	if !strings.Contains(literal, ".") {
+		literal += ".0"
+	}
+	return literal
+}
+
+// fluxString quotes a value as a Flux string literal so that identifiers
+// containing quotes or other special characters cannot break the query.
+func fluxString(value string) string {
+	return `"` + fluxStringEscaper.Replace(value) + `"`
+}
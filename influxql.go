@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// Query languages for the influxdb source
+const (
+	QueryLanguageFlux     = "flux"
+	QueryLanguageInfluxQL = "influxql"
+)
+
+// InfluxQLSource reads precipitation from InfluxDB 1.x with InfluxQL through
+// the /query endpoint, for servers without Flux enabled. The points of each
+// window are selected as is and reduced in Go like the other point sources.
+type InfluxQLSource struct {
+	pointSource
+}
+
+// influxQLResponse is the JSON returned by the /query endpoint
+type influxQLResponse struct {
+	Results []struct {
+		Series []struct {
+			Columns []string        `json:"columns"`
+			Values  [][]interface{} `json:"values"`
+		} `json:"series"`
+		Error string `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+// NewInfluxQLSource creates a source querying the configured InfluxDB with
+// InfluxQL.
+func NewInfluxQLSource(config *Configuration) *InfluxQLSource {
+	client := influxQLClient(config)
+	return &InfluxQLSource{pointSource{
+		config: config,
+		now:    time.Now,
+		origin: config.InfluxDB.Address,
+		load: func(start time.Time, stop time.Time) ([]precipPoint, error) {
+			return fetchInfluxQL(config, client, InfluxQLQuery(config, start, stop))
+		},
+	}}
+}
+
+// influxQLClient builds the HTTP client for InfluxQL queries with the TLS,
+// header, timeout and retry settings of the connection.
+func influxQLClient(config *Configuration) *http.Client {
+	db := config.InfluxDB
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: db.SkipVerifySsl},
+	}
+	return &http.Client{
+		Timeout: db.Timeout,
+		Transport: withRetries(&headerTransport{
+			base:    transport,
+			headers: db.Headers,
+		}, config.HTTP),
+	}
+}
+
+// InfluxQLQuery builds the InfluxQL selecting the precipitation points in
+// [start, stop), applying the configured tag filters.
+func InfluxQLQuery(config *Configuration, start time.Time, stop time.Time) string {
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE time >= %s AND time < %s`,
+		influxQLIdentifier(config.InfluxDB.Field), influxQLIdentifier(config.InfluxDB.Measurement),
+		influxQLString(start.UTC().Format(time.RFC3339Nano)), influxQLString(stop.UTC().Format(time.RFC3339Nano)))
+	if values := config.Query.IncludeTagValues; len(values) > 0 {
+		conditions := make([]string, len(values))
+		for i, value := range values {
+			conditions[i] = fmt.Sprintf("%s = %s", influxQLIdentifier(config.Query.TagKey), influxQLString(value))
+		}
+		query += " AND (" + strings.Join(conditions, " OR ") + ")"
+	}
+	for _, value := range config.Query.ExcludeTagValues {
+		query += fmt.Sprintf(" AND %s != %s", influxQLIdentifier(config.Query.TagKey), influxQLString(value))
+	}
+	return query
+}
+
+// fetchInfluxQL runs the query and returns the numeric points of every series.
+func fetchInfluxQL(config *Configuration, client *http.Client, query string) ([]precipPoint, error) {
+	db := config.InfluxDB
+	params := neturl.Values{}
+	params.Set("db", db.Database)
+	if db.RetentionPolicy != "" {
+		params.Set("rp", db.RetentionPolicy)
+	}
+	params.Set("epoch", "ns")
+	params.Set("q", query)
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(db.Address, "/")+"/query?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build InfluxQL request, %s", err)
+	}
+	if db.Token != "" {
+		req.Header.Set("Authorization", "Token "+db.Token)
+	} else if db.Username != "" && db.Password != "" {
+		req.SetBasicAuth(db.Username, db.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("InfluxQL query failed, %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading InfluxQL response, %s", err)
+	}
+
+	// Numbers are kept as written so nanosecond timestamps stay exact
+	var parsed influxQLResponse
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("unable to decode InfluxQL response (status %d), %s", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Client errors such as an unknown database will not go away on
+		// another attempt
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, fmt.Errorf("InfluxQL query failed (%w, status %d), %s", ErrNotRetryable, resp.StatusCode, parsed.Error)
+		}
+		return nil, fmt.Errorf("InfluxQL query failed (status %d), %s", resp.StatusCode, parsed.Error)
+	}
+
+	var points []precipPoint
+	for _, result := range parsed.Results {
+		if result.Error != "" {
+			return nil, fmt.Errorf("InfluxQL query failed (%w), %s", ErrNotRetryable, result.Error)
+		}
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				if len(row) < 2 || row[1] == nil {
+					continue
+				}
+				timestamp, ok := row[0].(json.Number)
+				nanos, err := timestamp.Int64()
+				if !ok || err != nil {
+					return nil, fmt.Errorf("unexpected InfluxQL timestamp %v", row[0])
+				}
+				number, ok := row[1].(json.Number)
+				value, err := number.Float64()
+				if !ok || err != nil {
+					return nil, fmt.Errorf("InfluxQL value %v is not numeric", row[1])
+				}
+				points = append(points, precipPoint{time: time.Unix(0, nanos), value: value})
+			}
+		}
+	}
+	return points, nil
+}
+
+// influxQLIdentifier quotes a measurement, field or tag name.
+func influxQLIdentifier(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// influxQLString quotes a string literal.
+func influxQLString(value string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + `'`
+}
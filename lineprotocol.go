@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultLineProtocolMeasurement is the measurement decisions are written to
+// when LineProtocol.Measurement is unset
+const defaultLineProtocolMeasurement = "robovac_decision"
+
+// lineProtocolEscaper escapes measurement names and tag values
+var lineProtocolEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// DecisionLine renders the run summary as a single line of InfluxDB line
+// protocol with nanosecond precision.
+func DecisionLine(measurement string, summary RunSummary) string {
+	if measurement == "" {
+		measurement = defaultLineProtocolMeasurement
+	}
+	tags := fmt.Sprintf(",action=%s", lineProtocolEscaper.Replace(summary.Action))
+	if summary.Device != "" {
+		tags += fmt.Sprintf(",device=%s", lineProtocolEscaper.Replace(summary.Device))
+	}
+	if summary.ReasonCode != "" {
+		tags += fmt.Sprintf(",reason_code=%s", lineProtocolEscaper.Replace(summary.ReasonCode))
+	}
+	fields := []string{
+		"act=" + strconv.FormatBool(summary.Act),
+		"success=" + strconv.FormatBool(summary.Success),
+		"webhook_fired=" + strconv.FormatBool(summary.WebhookFired),
+		"past_precip=" + strconv.FormatFloat(summary.PastPrecip, 'g', -1, 64),
+		"future_precip=" + strconv.FormatFloat(summary.FuturePrecip, 'g', -1, 64),
+		fmt.Sprintf("duration_ns=%di", summary.Duration.Nanoseconds()),
+	}
+	return fmt.Sprintf("%s%s %s %d\n", lineProtocolEscaper.Replace(measurement), tags, strings.Join(fields, ","),
+		summary.Timestamp.UnixNano())
+}
+
+// PostDecisionLine POSTs the run summary as line protocol to a write-only
+// endpoint such as Telegraf's influxdb_listener, without the InfluxDB client.
+func PostDecisionLine(config *Configuration, summary RunSummary) error {
+	line := DecisionLine(config.LineProtocol.Measurement, summary)
+	req, err := http.NewRequest(http.MethodPost, config.LineProtocol.URL, strings.NewReader(line))
+	if err != nil {
+		return fmt.Errorf("unable to build line protocol request, %s", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	for key, value := range config.LineProtocol.Headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: config.Vacuum.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %s", config.LineProtocol.URL, resp.Status)
+	}
+	return nil
+}
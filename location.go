@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// earthRadiusKm is the mean radius of the earth used for distances
+const earthRadiusKm = 6371.0
+
+// nearestPoint holds the tag values of the series chosen for a Location
+type nearestPoint struct {
+	latitude  string
+	longitude string
+}
+
+// NearestPoint returns the tag values of the stored series nearest to
+// Query.Location, along with its distance in kilometers.
+func (s *InfluxSource) NearestPoint(ctx context.Context) (*nearestPoint, float64, error) {
+	location := s.config.Query.Location
+	result, err := s.queryAPI.Query(ctx, NearestPointQuery(s.config, s.bucket))
+	if err != nil {
+		return nil, 0, queryError(err)
+	}
+	defer result.Close()
+
+	var nearest *nearestPoint
+	shortest := math.Inf(1)
+	for result.Next() {
+		latitude := fmt.Sprint(result.Record().ValueByKey(location.LatitudeTag))
+		longitude := fmt.Sprint(result.Record().ValueByKey(location.LongitudeTag))
+		lat, err := strconv.ParseFloat(latitude, 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(longitude, 64)
+		if err != nil {
+			continue
+		}
+		if distance := haversine(location.Latitude, location.Longitude, lat, lon); distance < shortest {
+			nearest = &nearestPoint{latitude: latitude, longitude: longitude}
+			shortest = distance
+		}
+	}
+	if result.Err() != nil {
+		return nil, 0, fmt.Errorf("failed parsing data from InfluxDB, %s", result.Err())
+	}
+	if nearest == nil {
+		return nil, 0, fmt.Errorf("no series with numeric %s and %s tags found, %w", location.LatitudeTag, location.LongitudeTag, ErrNoData)
+	}
+	return nearest, shortest, nil
+}
+
+// locationFilter builds the Flux filter step selecting the series of the
+// nearest point, once it has been resolved.
+func locationFilter(query Query) string {
+	if query.nearest == nil {
+		return ""
+	}
+	return fmt.Sprintf(`
+			|> filter(fn: (r) => r[%s] == %s and r[%s] == %s)`,
+		fluxString(query.Location.LatitudeTag), fluxString(query.nearest.latitude),
+		fluxString(query.Location.LongitudeTag), fluxString(query.nearest.longitude))
+}
+
+// haversine returns the great-circle distance in kilometers between two
+// points given in degrees.
+func haversine(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// Supported values for the -log-output flag
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+	LogOutputSyslog = "syslog"
+)
+
+// Supported values for Logging.Format
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Logging holds the format and level of the log output
+type Logging struct {
+	Format string
+	Level  string
+}
+
+// ConfigureLogging applies the configured format and level once the
+// configuration is loaded; lines logged before keep the text format and the
+// info level. The text format keeps the colors set by ConfigureColors.
+func ConfigureLogging(logging Logging) error {
+	if logging.Format == LogFormatJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	if logging.Level != "" {
+		level, err := log.ParseLevel(logging.Level)
+		if err != nil {
+			return fmt.Errorf("unknown log level %s", logging.Level)
+		}
+		log.SetLevel(level)
+	}
+	return nil
+}
+
+// validateLogging checks the log format and level.
+func validateLogging(logging Logging) error {
+	switch logging.Format {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %s", logging.Format)
+	}
+	if logging.Level != "" {
+		if _, err := log.ParseLevel(logging.Level); err != nil {
+			return fmt.Errorf("unknown log level %s", logging.Level)
+		}
+	}
+	return nil
+}
+
+// ConfigureLogOutput points logrus at the requested destination.
+func ConfigureLogOutput(output string, facility string, tag string) error {
+	switch output {
+	case LogOutputStdout:
+		log.SetOutput(os.Stdout)
+	case LogOutputStderr:
+		log.SetOutput(os.Stderr)
+	case LogOutputSyslog:
+		return configureSyslog(facility, tag)
+	default:
+		return fmt.Errorf("unknown log output %s", output)
+	}
+	return nil
+}
+
+// ConfigureColors sets whether console log output is colored. By default
+// logrus colors output only when writing to a terminal; force and disable
+// override that detection.
+func ConfigureColors(force bool, disable bool) {
+	log.SetFormatter(&log.TextFormatter{
+		ForceColors:   force,
+		DisableColors: disable,
+	})
+}
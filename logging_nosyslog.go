@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+)
+
+// configureSyslog reports that syslog is unavailable on this platform.
+func configureSyslog(facility string, tag string) error {
+	return fmt.Errorf("syslog output is not supported on this platform")
+}
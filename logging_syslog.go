@@ -0,0 +1,52 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	logrusSyslog "github.com/sirupsen/logrus/hooks/syslog"
+	"io"
+	"log/syslog"
+)
+
+// syslogFacilities maps facility names to their syslog priority
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// configureSyslog sends all log entries to the local syslog daemon instead
+// of the console.
+func configureSyslog(facility string, tag string) error {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %s", facility)
+	}
+
+	hook, err := logrusSyslog.NewSyslogHook("", "", priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return fmt.Errorf("unable to connect to syslog, %s", err)
+	}
+	log.AddHook(hook)
+	log.SetOutput(io.Discard)
+	return nil
+}
@@ -3,71 +3,397 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	influx "github.com/influxdata/influxdb-client-go/v2"
-	influxAPI "github.com/influxdata/influxdb-client-go/v2/api"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 // BuildVersion is the software build version
 var BuildVersion = "UNKNOWN"
 
+// deadlineExitCode is the exit code used when -deadline is exceeded, matching
+// timeout(1)
+const deadlineExitCode = 124
+
 // Configuration represents a YAML-formatted config file
 type Configuration struct {
-	Vacuum   Vacuum
-	Query    Query
-	InfluxDB InfluxDB
+	Source         string
+	Vacuum         Vacuum
+	Query          Query
+	InfluxDB       InfluxDB
+	CSV            CSV
+	API            API
+	Forecast       Forecast
+	Confidence     Confidence
+	Probability    Probability
+	SoilMoisture   SoilMoisture
+	SevereWeather  SevereWeather
+	Schedule       Schedule
+	Dew            Dew
+	Observed       Observed
+	EventWebhook   string
+	Connections    map[string]InfluxDB
+	HeartbeatFile  string
+	Notify         Notify
+	LineProtocol   LineProtocol
+	EventSocket    EventSocket
+	HTTP           HTTP
+	Logging        Logging
+	History        History
+	DryRun         bool
+	PrometheusFile string
+	StateFile      string
+	Rules          []Rule
+	Weekdays       map[string]WeekdayOverride
+	Vacuums        []Device
+	metrics        *Metrics
+	device         string
+	onSummary      func(RunSummary)
+	asOf           time.Time
+	decideOnly     bool
+	conflicted     map[string]bool
 }
 
 // Vacuum holds the parameters for controlling the robot vacuum
 type Vacuum struct {
-	WebhookStart  string
-	WebhookStop   string
-	SkipVerifySsl bool
+	Protocol             string
+	WebhookStart         string
+	WebhookStarts        []string
+	WebhookSelection     string
+	WebhookStop          string
+	WebhookReturn        string
+	ReturnToBase         bool
+	IDs                  []string
+	Start                WebhookRequest
+	Stop                 WebhookRequest
+	Return               WebhookRequest
+	SkipVerifySsl        bool
+	Timeout              time.Duration
+	ResponseField        string
+	ResponseSuccessValue string
+	SuccessStatusCodes   []int
+	MQTT                 MQTT
+	HomeAssistant        HomeAssistant
+	Tuya                 Tuya
+	PreStartCommand      []string
+	PostStartCommand     []string
+	PreStopCommand       []string
+	PostStopCommand      []string
+	VerifyAfter          time.Duration
+	VerifyConnection     string
+	VerifyMeasurement    string
+	VerifyField          string
+	VerifyExpected       string
+	VerifyRetry          bool
+	StatusConnection     string
+	StatusMeasurement    string
+	StatusField          string
+	IdleValues           []string
+	StatusMaxAge         time.Duration
+	StopGracePeriod      time.Duration
+	StopLeadTime         time.Duration
+	FailsafeStopAfter    int
 }
 
 // Query holds the parameters for querying the forecast query
 type Query struct {
-	LookbackDuration    string
-	LookforwardDuration string
+	LookbackDuration      string
+	LookforwardDuration   string
+	LookforwardOffset     string
+	TruncateNow           string
+	SkipLookback          bool
+	StartRule             string
+	StartThreshold        float64
+	PastPrecipThreshold   float64
+	FuturePrecipThreshold float64
+	StartExpression       string
+	PastWeight            float64
+	FutureWeight          float64
+	MinSignificant        float64
+	MinDrySince           string
+	DryDaysRequired       int
+	DryDaysWindow         int
+	Conditions            []Condition
+	ConditionPolicy       string
+	MaxDataAge            time.Duration
+	RefreshWebhook        string
+	RefreshWait           time.Duration
+	Connection            string
+	ValueColumn           string
+	Location              Location
+	TagKey                string
+	IncludeTagValues      []string
+	ExcludeTagValues      []string
+	PerTagThresholds      map[string]float64
+	IssueTimeTag          string
+	WetInterval           string
+	WetAmountThreshold    float64
+	WetDurationThreshold  string
+	WindowEvery           string
+	SampleEvery           int
+	SampleMinWindow       string
+	SmoothingFactor       float64
+	NonFinitePolicy       string
+	MultipleFieldsPolicy  string
+	StopNoDataPolicy      string
+	ReportDryWindow       bool
+	LookbackFluxFile      string
+	LookforwardFluxFile   string
+	nearest               *nearestPoint
 }
 
 // InfluxDB holds the connection parameters for InfluxDB
 type InfluxDB struct {
-	Address         string
-	Username        string
-	Password        string
-	Measurement     string
-	Field           string
-	Database        string
-	RetentionPolicy string
-	Token           string
-	Organization    string
-	Bucket          string
-	SkipVerifySsl   bool
+	Address             string
+	Username            string
+	Password            string
+	Measurement         string
+	Field               string
+	Database            string
+	RetentionPolicy     string
+	Token               string
+	Organization        string
+	Bucket              string
+	Buckets             []string
+	SkipVerifySsl       bool
+	Headers             map[string]string
+	Timeout             time.Duration
+	HealthCheckAttempts int
+	HealthCheckDelay    time.Duration
+	QueryLanguage       string
+}
+
+// Condition is a check on a series other than precipitation, e.g. wind gust
+// or temperature, that can block starting the vacuum
+type Condition struct {
+	Name        string
+	Connection  string
+	Measurement string
+	Field       string
+	Window      string
+	Aggregation string
+	Operator    string
+	Value       float64
+}
+
+// Schedule holds the parameters for evaluating actions in daemon mode, and
+// the windows the vacuum may be started in, which apply to every run
+type Schedule struct {
+	EvaluateEvery  time.Duration
+	Actions        []string
+	MetricsAddress string
+	AllowedWindows []string
+	ConflictPolicy string
+}
+
+// SevereWeather holds the series carrying a severe weather alert, which stops
+// the vacuum and prevents starting it regardless of precipitation
+type SevereWeather struct {
+	Connection  string
+	Measurement string
+	Field       string
+	MaxAge      time.Duration
+}
+
+// Location selects the forecast series stored for the point nearest to the
+// given coordinates, with the coordinates of each series held in two tags
+type Location struct {
+	Latitude     float64
+	Longitude    float64
+	LatitudeTag  string
+	LongitudeTag string
+}
+
+// EventSocket holds the unix socket or named pipe receiving the run summary
+type EventSocket struct {
+	Path     string
+	Optional bool
+}
+
+// Rule is a start condition with the webhook fired when it is the first to
+// match
+type Rule struct {
+	Name       string
+	Expression string
+	Webhook    WebhookRequest
+}
+
+// Forecast holds the parameters for fetching precipitation from a public
+// forecast API
+type Forecast struct {
+	Provider       string
+	APIKey         string
+	Latitude       float64
+	Longitude      float64
+	URL            string
+	Timeout        time.Duration
+	UserAgent      string
+	MinProbability float64
+}
+
+// API holds the parameters for fetching precipitation from a weather API
+// returning JSON
+type API struct {
+	URL         string
+	Headers     map[string]string
+	TimePath    string
+	ValuePath   string
+	Aggregation string
+	Timeout     time.Duration
+}
+
+// CSV holds the parameters for reading precipitation from a local CSV file
+type CSV struct {
+	Path string
+}
+
+// Confidence holds the parameters for gating the start decision on the
+// forecast confidence
+type Confidence struct {
+	Connection  string
+	Measurement string
+	Field       string
+	Minimum     float64
+}
+
+// Probability holds the parameters for gating the start decision on the
+// probability of precipitation, in percent, which forecasts often report
+// high while the expected amount is still zero. The check is enabled by
+// setting Maximum. The forecast source reads the probability from the
+// provider; the influxdb source from Field.
+type Probability struct {
+	Connection  string
+	Measurement string
+	Field       string
+	Maximum     *float64
+}
+
+// SoilMoisture holds the parameters for gating the start decision on a
+// ground moisture sensor
+type SoilMoisture struct {
+	Connection  string
+	Measurement string
+	Field       string
+	Maximum     float64
+	MaxAge      time.Duration
+}
+
+// Observed holds the parameters for cross-checking the forecast against an
+// observed precipitation series
+type Observed struct {
+	Connection  string
+	Measurement string
+	Field       string
+}
+
+// Dew holds the parameters for gating the start decision on the forecast
+// temperature approaching the dew point
+type Dew struct {
+	Connection       string
+	Measurement      string
+	TemperatureField string
+	DewPointField    string
+	Margin           float64
+}
+
+// Notify holds the parameters for sending notifications about runs through
+// Apprise or any of the services supported natively
+type Notify struct {
+	AppriseURL   string
+	Pushover     Pushover
+	Telegram     Telegram
+	Slack        Slack
+	Email        Email
+	Title        string
+	On           []string
+	OnChangeOnly bool
+}
+
+// LineProtocol holds the parameters for posting decisions as InfluxDB line
+// protocol to a write endpoint
+type LineProtocol struct {
+	URL         string
+	Measurement string
+	Headers     map[string]string
 }
 
 // CliInputs holds the data passed in via CLI parameters
 type CliInputs struct {
-	BuildVersion string
-	Config       string
-	Action       string
-	ShowVersion  bool
+	BuildVersion   string
+	Config         string
+	ConfigType     string
+	Action         string
+	ShowVersion    bool
+	LogOutput      string
+	SyslogFacility string
+	SyslogTag      string
+	Diagnostics    bool
+	Quiet          bool
+	Attempts       int
+	AttemptDelay   time.Duration
+	Color          bool
+	NoColor        bool
+	Force          bool
+	TemplateConfig bool
+	MetricsJSON    bool
+	Deadline       time.Duration
+	PrintQuery     bool
+	Init           bool
+	Latitude       float64
+	Longitude      float64
+	CorrelationID  string
+	Daemon         bool
+	DryRun         bool
+	History        bool
+	HistoryLimit   int
+	AsOf           string
 }
 
-// LoadConfiguration takes a file path as input and loads the YAML-formatted
-// configuration there.
-func LoadConfiguration(configPath string) (*Configuration, error) {
+// LoadConfiguration takes a file path as input and loads the configuration
+// there. The format (yaml, json or toml) is taken from configType, or inferred
+// from the file extension when empty and defaults to YAML. When templated the
+// file is first rendered as a Go template, delimited by [[ and ]], with the
+// environment available as .Env and the env function.
+func LoadConfiguration(configPath string, configType string, templated bool) (*Configuration, error) {
 	viper.SetConfigFile(configPath)
 	viper.AutomaticEnv()
 
-	viper.SetConfigType("yml")
+	switch strings.ToLower(configType) {
+	case "":
+		// unknown extensions, e.g. .conf, are read as YAML
+		switch strings.ToLower(filepath.Ext(configPath)) {
+		case ".json":
+			viper.SetConfigType("json")
+		case ".toml":
+			viper.SetConfigType("toml")
+		default:
+			viper.SetConfigType("yml")
+		}
+	case "yaml", "yml":
+		viper.SetConfigType("yml")
+	case "json", "toml":
+		viper.SetConfigType(strings.ToLower(configType))
+	default:
+		return nil, fmt.Errorf("unsupported config type %s", configType)
+	}
 
-	if err := viper.ReadInConfig(); err != nil {
+	if templated {
+		rendered, err := RenderConfigTemplate(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := viper.ReadConfig(rendered); err != nil {
+			return nil, fmt.Errorf("error reading config file, %s", err)
+		}
+	} else if err := viper.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("error reading config file, %s", err)
 	}
 
@@ -80,26 +406,442 @@ func LoadConfiguration(configPath string) (*Configuration, error) {
 	return &configuration, nil
 }
 
-// Connect establishes an InfluxDB client
-func InfluxConnect(config *Configuration) (influx.Client, influxAPI.QueryAPI, error) {
-	var auth string
-	if config.InfluxDB.Token != "" {
-		auth = config.InfluxDB.Token
-	} else if config.InfluxDB.Username != "" && config.InfluxDB.Password != "" {
-		auth = fmt.Sprintf("%s:%s", config.InfluxDB.Username, config.InfluxDB.Password)
-	} else {
-		auth = ""
+// usesInflux reports whether precipitation is queried from InfluxDB with
+// Flux, which the features relying on Flux queries require.
+func (c *Configuration) usesInflux() bool {
+	return (c.Source == "" || c.Source == SourceInfluxDB) && c.InfluxDB.QueryLanguage != QueryLanguageInfluxQL
+}
+
+// validateProbability checks the probability of precipitation check, which
+// the forecast source supports through its provider and the influxdb source
+// through a configured field.
+func (c *Configuration) validateProbability() error {
+	if c.Probability.Maximum == nil {
+		return nil
 	}
+	if *c.Probability.Maximum < 0 || *c.Probability.Maximum > 100 {
+		return fmt.Errorf("probability.maximum must be between 0 and 100")
+	}
+	switch {
+	case c.Source == SourceForecast:
+	case c.usesInflux():
+		if c.Probability.Field == "" {
+			return fmt.Errorf("probability.field must be set when checking the probability of precipitation")
+		}
+	default:
+		return fmt.Errorf("probability of precipitation checks require the influxdb or forecast source")
+	}
+	return nil
+}
 
-	options := influx.DefaultOptions().
-		SetTLSConfig(&tls.Config{
-			InsecureSkipVerify: config.InfluxDB.SkipVerifySsl,
-		})
-	client := influx.NewClientWithOptions(config.InfluxDB.Address, auth, options)
+// Evaluate runs the requested action, retrying failed runs up to
+// cliInputs.Attempts times, and records the outcome of the final attempt in
+// the heartbeat and the state file. The source is passed on to Run. The error
+// of the final attempt is returned.
+func Evaluate(ctx context.Context, configuration *Configuration, cliInputs CliInputs, source Source) error {
+	for attempt := 1; ; attempt++ {
+		logger := log.WithField("action", cliInputs.Action)
+		if configuration.device != "" {
+			logger = logger.WithField("device", configuration.device)
+		}
+		if cliInputs.Attempts > 1 {
+			logger = logger.WithField("attempt", attempt)
+		}
 
-	queryAPI := client.QueryAPI(config.InfluxDB.Organization)
+		err := Run(ctx, configuration, cliInputs, source, logger)
+		final := err == nil || attempt >= cliInputs.Attempts || errors.Is(err, ErrNotRetryable)
+		if final && configuration.Vacuum.FailsafeStopAfter > 0 && !configuration.DryRun {
+			if err := RecordRunOutcome(configuration, err, logger); err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "RecordRunOutcome",
+					"error": err,
+				}).Warn("failed to record run outcome")
+			}
+		}
+		if err == nil {
+			if configuration.HeartbeatFile != "" {
+				if err := WriteHeartbeat(configuration.HeartbeatFile, time.Now()); err != nil {
+					logger.WithFields(log.Fields{
+						"op":    "WriteHeartbeat",
+						"error": err,
+					}).Warn("failed to write heartbeat")
+				}
+			}
+			return nil
+		}
+		if final {
+			return err
+		}
+		logger.WithFields(log.Fields{
+			"op":    "Evaluate",
+			"error": err,
+			"delay": cliInputs.AttemptDelay,
+		}).Error("evaluation failed, retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(cliInputs.AttemptDelay):
+		}
+	}
+}
+
+// Validate checks the loaded configuration for settings that cannot be
+// acted upon.
+func (c *Configuration) Validate() error {
+	if c.History.MaxAge < 0 {
+		return fmt.Errorf("history.maxAge must not be negative")
+	}
+	if c.HTTP.Retries < 0 {
+		return fmt.Errorf("http.retries must not be negative")
+	}
+	if err := validateStartRule(c.Query); err != nil {
+		return err
+	}
+	if err := validateRules(c); err != nil {
+		return err
+	}
+	if err := validateDevices(c); err != nil {
+		return err
+	}
+	if err := validateConditions(c.Query); err != nil {
+		return err
+	}
+	if len(c.Query.Conditions) > 0 && !c.usesInflux() {
+		return fmt.Errorf("conditions require the influxdb source")
+	}
+	if (len(c.Query.IncludeTagValues) > 0 || len(c.Query.ExcludeTagValues) > 0) && c.Query.TagKey == "" {
+		return fmt.Errorf("tagKey must be set when filtering by tag values")
+	}
+	switch c.Source {
+	case "", SourceInfluxDB:
+		switch c.InfluxDB.QueryLanguage {
+		case "", QueryLanguageFlux:
+		case QueryLanguageInfluxQL:
+			if c.InfluxDB.Database == "" {
+				return fmt.Errorf("influxDB.database must be set when querying with influxql")
+			}
+			if len(c.InfluxDB.Buckets) > 0 {
+				return fmt.Errorf("influxDB.buckets cannot be used when querying with influxql")
+			}
+		default:
+			return fmt.Errorf("unknown query language %s", c.InfluxDB.QueryLanguage)
+		}
+	case SourceCSV:
+		if c.CSV.Path == "" {
+			return fmt.Errorf("csv.path must be set when using the csv source")
+		}
+	case SourceForecast:
+		if err := validateForecast(c.Forecast); err != nil {
+			return err
+		}
+	case SourceAPI:
+		if c.API.URL == "" || c.API.TimePath == "" || c.API.ValuePath == "" {
+			return fmt.Errorf("api.url, api.timePath and api.valuePath must be set when using the api source")
+		}
+		switch c.API.Aggregation {
+		case "", AggregateMax, AggregateSum:
+		default:
+			return fmt.Errorf("unknown api aggregation %s", c.API.Aggregation)
+		}
+	default:
+		return fmt.Errorf("unknown source %s", c.Source)
+	}
+	if c.usesInflux() && c.InfluxDB.Token != "" && c.InfluxDB.Organization == "" {
+		return fmt.Errorf("influxDB.organization is required when using token auth")
+	}
+	for name, db := range c.Connections {
+		if db.Token != "" && db.Organization == "" {
+			return fmt.Errorf("connections.%s.organization is required when using token auth", name)
+		}
+	}
+	switch c.Query.NonFinitePolicy {
+	case "", NonFiniteError, NonFiniteWet, NonFiniteDry:
+	default:
+		return fmt.Errorf("unknown non-finite policy %s", c.Query.NonFinitePolicy)
+	}
+	switch c.Query.MultipleFieldsPolicy {
+	case "", MultipleFieldsError, MultipleFieldsMax:
+	default:
+		return fmt.Errorf("unknown multiple fields policy %s", c.Query.MultipleFieldsPolicy)
+	}
+	switch c.Query.StopNoDataPolicy {
+	case "", StopNoDataError, StopNoDataStop, StopNoDataLeave:
+	default:
+		return fmt.Errorf("unknown stop no-data policy %s", c.Query.StopNoDataPolicy)
+	}
+	for _, path := range []string{c.Query.LookbackFluxFile, c.Query.LookforwardFluxFile} {
+		if path == "" {
+			continue
+		}
+		if !c.usesInflux() {
+			return fmt.Errorf("flux files require the influxdb source")
+		}
+		if _, err := parseFluxFile(path); err != nil {
+			return err
+		}
+	}
+	if _, err := ParseFluxDuration(c.Query.SampleMinWindow); err != nil {
+		return fmt.Errorf("invalid sampleMinWindow, %s", err)
+	}
+	if c.Query.MaxDataAge > 0 && !c.usesInflux() {
+		return fmt.Errorf("maxDataAge requires the influxdb source")
+	}
+	if c.Query.MinDrySince != "" {
+		if _, err := ParseFluxDuration(c.Query.MinDrySince); err != nil {
+			return fmt.Errorf("invalid minDrySince, %s", err)
+		}
+	}
+	if c.Query.DryDaysRequired > 0 {
+		if !c.usesInflux() {
+			return fmt.Errorf("dry-day counting requires the influxdb source")
+		}
+		if c.Query.DryDaysWindow < c.Query.DryDaysRequired {
+			return fmt.Errorf("dryDaysWindow must be at least dryDaysRequired")
+		}
+	}
+	if !c.asOf.IsZero() && c.Source != SourceCSV {
+		return fmt.Errorf("-as-of requires the csv source")
+	}
+	if c.Query.IssueTimeTag != "" && !c.usesInflux() {
+		return fmt.Errorf("issueTimeTag requires the influxdb source")
+	}
+	if len(c.Query.PerTagThresholds) > 0 {
+		if c.Query.TagKey == "" {
+			return fmt.Errorf("tagKey must be set when using per-tag thresholds")
+		}
+		if !c.usesInflux() {
+			return fmt.Errorf("per-tag thresholds require the influxdb source")
+		}
+		// The windows are judged against the thresholds of the start rule,
+		// which the weighted and expression rules do not have
+		switch c.Query.StartRule {
+		case StartRuleWeighted, StartRuleExpression:
+			return fmt.Errorf("per-tag thresholds cannot be used with the %s start rule", c.Query.StartRule)
+		}
+		if len(c.Rules) > 0 {
+			return fmt.Errorf("per-tag thresholds cannot be used with rules")
+		}
+	}
+	names := []string{c.Query.Connection, c.Confidence.Connection, c.Probability.Connection, c.SoilMoisture.Connection, c.Dew.Connection,
+		c.Observed.Connection, c.SevereWeather.Connection,
+		c.Vacuum.StatusConnection, c.Vacuum.VerifyConnection}
+	for _, condition := range c.Query.Conditions {
+		names = append(names, condition.Connection)
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if !c.usesInflux() {
+			return fmt.Errorf("named connections require the influxdb source")
+		}
+		if _, ok := c.Connections[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("unknown InfluxDB connection %s", name)
+		}
+	}
+	if err := validateLogging(c.Logging); err != nil {
+		return err
+	}
+	if err := validateNotify(c.Notify); err != nil {
+		return err
+	}
+	if c.Notify.OnChangeOnly && c.StateFile == "" {
+		return fmt.Errorf("stateFile must be set for notify.onChangeOnly")
+	}
+	if err := validateWeekdays(c.Weekdays, c.Query); err != nil {
+		return err
+	}
+	if c.Confidence.Field != "" && !c.usesInflux() {
+		return fmt.Errorf("confidence requires the influxdb source")
+	}
+	if err := c.validateProbability(); err != nil {
+		return err
+	}
+	if c.Observed.Field != "" {
+		if !c.usesInflux() {
+			return fmt.Errorf("observed precipitation checks require the influxdb source")
+		}
+		if c.Observed.Measurement == "" {
+			return fmt.Errorf("observed.measurement must be set when checking observed precipitation")
+		}
+		if c.Query.SkipLookback {
+			return fmt.Errorf("observed precipitation checks cannot be combined with skipLookback")
+		}
+	}
+	if c.Dew.TemperatureField != "" {
+		if !c.usesInflux() {
+			return fmt.Errorf("dew checks require the influxdb source")
+		}
+		if c.Dew.DewPointField == "" {
+			return fmt.Errorf("dew.dewPointField must be set when checking for dew")
+		}
+	}
+	if c.SoilMoisture.Field != "" {
+		if !c.usesInflux() {
+			return fmt.Errorf("soil moisture checks require the influxdb source")
+		}
+		if c.SoilMoisture.Measurement == "" {
+			return fmt.Errorf("soilMoisture.measurement must be set when checking soil moisture")
+		}
+	}
+	if c.Schedule.EvaluateEvery < 0 {
+		return fmt.Errorf("schedule.evaluateEvery must not be negative")
+	}
+	for _, action := range c.Schedule.Actions {
+		if action != "start" && action != "stop" {
+			return fmt.Errorf("unknown scheduled action %s", action)
+		}
+	}
+	for _, window := range c.Schedule.AllowedWindows {
+		if _, err := parseAllowedWindow(window); err != nil {
+			return err
+		}
+	}
+	switch c.Schedule.ConflictPolicy {
+	case "", ConflictSafest, ConflictPreferStart, ConflictPreferStop:
+	default:
+		return fmt.Errorf("unknown conflict policy %s", c.Schedule.ConflictPolicy)
+	}
+	if c.SevereWeather.Field != "" {
+		if !c.usesInflux() {
+			return fmt.Errorf("severe weather checks require the influxdb source")
+		}
+		if c.SevereWeather.Measurement == "" {
+			return fmt.Errorf("severeWeather.measurement must be set when checking for severe weather")
+		}
+	}
+	if c.Vacuum.VerifyField != "" {
+		if !c.usesInflux() {
+			return fmt.Errorf("start verification requires the influxdb source")
+		}
+		if c.Vacuum.VerifyMeasurement == "" || c.Vacuum.VerifyAfter <= 0 {
+			return fmt.Errorf("verifyMeasurement and verifyAfter must be set when verifying the start")
+		}
+	}
+	if c.Vacuum.StatusField != "" {
+		if !c.usesInflux() {
+			return fmt.Errorf("vacuum status checks require the influxdb source")
+		}
+		if c.Vacuum.StatusMeasurement == "" || len(c.Vacuum.IdleValues) == 0 {
+			return fmt.Errorf("statusMeasurement and idleValues must be set when checking the vacuum status")
+		}
+	}
+	if (c.Query.Location.LatitudeTag == "") != (c.Query.Location.LongitudeTag == "") {
+		return fmt.Errorf("location.latitudeTag and location.longitudeTag must be set together")
+	}
+	if c.Query.Location.LatitudeTag != "" {
+		if !c.usesInflux() {
+			return fmt.Errorf("location selection requires the influxdb source")
+		}
+		if math.Abs(c.Query.Location.Latitude) > 90 || math.Abs(c.Query.Location.Longitude) > 180 {
+			return fmt.Errorf("location coordinates %v,%v are out of range", c.Query.Location.Latitude, c.Query.Location.Longitude)
+		}
+	}
+	if c.Query.PastPrecipThreshold < 0 || c.Query.FuturePrecipThreshold < 0 {
+		return fmt.Errorf("pastPrecipThreshold and futurePrecipThreshold must not be negative")
+	}
+	if c.Query.SmoothingFactor < 0 || c.Query.SmoothingFactor > 1 {
+		return fmt.Errorf("smoothingFactor must be between 0 and 1")
+	}
+	if c.Query.SmoothingFactor > 0 && c.StateFile == "" {
+		return fmt.Errorf("stateFile must be set for smoothingFactor")
+	}
+	if c.Query.ReportDryWindow && !c.usesInflux() {
+		return fmt.Errorf("reporting the expected dry window requires the influxdb source")
+	}
+	if c.Vacuum.StopLeadTime > 0 && !c.usesInflux() {
+		return fmt.Errorf("stopLeadTime requires the influxdb source")
+	}
+	if c.Vacuum.FailsafeStopAfter > 0 {
+		if c.StateFile == "" {
+			return fmt.Errorf("stateFile must be set for failsafeStopAfter")
+		}
+		if !c.Vacuum.hasStop() {
+			return fmt.Errorf("a stop webhook or mqtt.stop.topic must be set for failsafeStopAfter")
+		}
+	}
+	switch c.Vacuum.WebhookSelection {
+	case "", WebhookSelectionRandom:
+	case WebhookSelectionRoundRobin:
+		if len(c.Vacuum.WebhookStarts) > 0 && c.StateFile == "" {
+			return fmt.Errorf("stateFile must be set for round-robin webhook selection")
+		}
+	default:
+		return fmt.Errorf("unknown webhook selection %s", c.Vacuum.WebhookSelection)
+	}
+	for _, webhook := range c.Vacuum.WebhookStarts {
+		if _, err := WebhookURLs(c, webhook); err != nil {
+			return err
+		}
+	}
+	switch c.Vacuum.Protocol {
+	case "", ProtocolHTTP:
+	case ProtocolMQTT:
+		if err := validateMQTT(c); err != nil {
+			return err
+		}
+	case ProtocolHomeAssistant:
+		if err := validateHomeAssistant(c); err != nil {
+			return err
+		}
+	case ProtocolTuya:
+		if err := validateTuya(c); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown vacuum protocol %s", c.Vacuum.Protocol)
+	}
+	for _, code := range c.Vacuum.SuccessStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid webhook success status code %d", code)
+		}
+	}
+	if c.Vacuum.ResponseField != "" {
+		if _, err := parseJSONPath(c.Vacuum.ResponseField); err != nil {
+			return fmt.Errorf("invalid responseField, %s", err)
+		}
+	}
+	if c.Vacuum.ReturnToBase && c.Vacuum.usesWebhooks() && c.Vacuum.StopWebhook().URL == "" {
+		return fmt.Errorf("webhookReturn or return.url must be set when returnToBase is enabled")
+	}
+	for _, webhook := range []WebhookRequest{
+		c.Vacuum.StartWebhook(),
+		c.Vacuum.Stop.withURL(c.Vacuum.WebhookStop),
+		c.Vacuum.Return.withURL(c.Vacuum.WebhookReturn),
+	} {
+		if _, err := WebhookURLs(c, webhook.URL); err != nil {
+			return err
+		}
+		if _, err := WebhookBodies(c, webhook.Body, WebhookData{}); err != nil {
+			return err
+		}
+		for _, value := range webhook.Headers {
+			if _, err := WebhookBodies(c, value, WebhookData{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	return client, queryAPI, nil
+// applyCliOverrides sets the parameters given on the command line over the
+// configuration.
+func applyCliOverrides(configuration *Configuration, cliInputs CliInputs, flags *flag.FlagSet) {
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "lat":
+			configuration.Query.Location.Latitude = cliInputs.Latitude
+			configuration.Forecast.Latitude = cliInputs.Latitude
+		case "lon":
+			configuration.Query.Location.Longitude = cliInputs.Longitude
+			configuration.Forecast.Longitude = cliInputs.Longitude
+		case "dry-run":
+			configuration.DryRun = cliInputs.DryRun
+		case "as-of":
+			// checked to be RFC3339 when the flags are parsed
+			configuration.asOf, _ = time.Parse(time.RFC3339, cliInputs.AsOf)
+		}
+	})
 }
 
 func main() {
@@ -109,8 +851,32 @@ func main() {
 	}
 	flags := flag.NewFlagSet("outdoor-robovac-trigger", 0)
 	flags.StringVar(&cliInputs.Config, "config", "config.yaml", "Set the location for the YAML config file")
+	flags.StringVar(&cliInputs.ConfigType, "config-type", "", "Set the config file format; one of yaml, json or toml, inferred from the file extension by default")
 	flags.StringVar(&cliInputs.Action, "action", "start", "Set action for outdoor-robovac-trigger; start will decide whether to start the vacuum and stop will decide whether to stop it based on the forecast")
 	flags.BoolVar(&cliInputs.ShowVersion, "version", false, "Print the version of outdoor-robovac-trigger")
+	flags.StringVar(&cliInputs.LogOutput, "log-output", LogOutputStderr, "Set where logs are written; one of stdout, stderr or syslog")
+	flags.StringVar(&cliInputs.SyslogFacility, "syslog-facility", "daemon", "Set the syslog facility used when -log-output is syslog")
+	flags.StringVar(&cliInputs.SyslogTag, "syslog-tag", "outdoor-robovac-trigger", "Set the syslog tag used when -log-output is syslog")
+	flags.BoolVar(&cliInputs.Diagnostics, "diagnostics", false, "Run every configured query, print each value retrieved and exit without taking action")
+	flags.BoolVar(&cliInputs.Quiet, "quiet", false, "Only log when a webhook is fired or an error occurs")
+	flags.IntVar(&cliInputs.Attempts, "attempts", 1, "Set how many times the whole evaluation is attempted before giving up")
+	flags.DurationVar(&cliInputs.AttemptDelay, "attempt-delay", 30*time.Second, "Set the delay between evaluation attempts")
+	flags.BoolVar(&cliInputs.Color, "color", false, "Force colored log output even when not writing to a terminal")
+	flags.BoolVar(&cliInputs.NoColor, "no-color", false, "Disable colored log output even when writing to a terminal")
+	flags.BoolVar(&cliInputs.Force, "force", false, "Fire the webhook for the action without querying the forecast, running hooks or applying any guard")
+	flags.BoolVar(&cliInputs.TemplateConfig, "template-config", false, "Render the config file as a Go template delimited by [[ and ]], with access to environment variables, before parsing it")
+	flags.BoolVar(&cliInputs.MetricsJSON, "metrics-json", false, "Print a single JSON line of metrics for each run to stdout")
+	flags.DurationVar(&cliInputs.Deadline, "deadline", 0, "Forcibly exit with code 124 if the program has not finished within this duration; 0 disables the watchdog")
+	flags.BoolVar(&cliInputs.PrintQuery, "print-query", false, "Print the lookback and lookforward Flux queries and exit without connecting to InfluxDB")
+	flags.BoolVar(&cliInputs.Init, "init", false, "Write an annotated example config to the -config path, refusing to overwrite an existing file, and exit")
+	flags.Float64Var(&cliInputs.Latitude, "lat", 0, "Set the latitude of the forecast point to use, overriding query.location.latitude and forecast.latitude")
+	flags.Float64Var(&cliInputs.Longitude, "lon", 0, "Set the longitude of the forecast point to use, overriding query.location.longitude and forecast.longitude")
+	flags.StringVar(&cliInputs.CorrelationID, "correlation-id", "", "Set the ID added to every log line and sent as the X-Correlation-ID header on outbound requests; a random UUID by default, and a new one for every evaluation in daemon mode")
+	flags.BoolVar(&cliInputs.DryRun, "dry-run", false, "Run every query and the decision logic but only log the action that would be taken instead of firing webhooks and hooks; overrides dryRun in the config")
+	flags.BoolVar(&cliInputs.History, "history", false, "Print the most recent runs recorded in history.path and exit")
+	flags.IntVar(&cliInputs.HistoryLimit, "history-limit", 20, "Set how many runs -history prints; 0 prints every recorded run")
+	flags.StringVar(&cliInputs.AsOf, "as-of", "", "Evaluate the csv source as of this RFC3339 time instead of now, e.g. to replay recorded data")
+	flags.BoolVar(&cliInputs.Daemon, "daemon", false, "Keep running and evaluate the actions in schedule.actions, or -action, every schedule.evaluateEvery until SIGTERM or SIGINT")
 	flags.Parse(os.Args[1:])
 
 	if cliInputs.ShowVersion {
@@ -118,13 +884,62 @@ func main() {
 		os.Exit(0)
 	}
 
+	ConfigureColors(cliInputs.Color, cliInputs.NoColor)
+	if err := ConfigureLogOutput(cliInputs.LogOutput, cliInputs.SyslogFacility, cliInputs.SyslogTag); err != nil {
+		log.WithFields(log.Fields{
+			"op":    "ConfigureLogOutput",
+			"error": err,
+		}).Fatal("failed to configure log output")
+	}
+
+	ConfigureCorrelationID(cliInputs.CorrelationID)
+
+	if cliInputs.Init {
+		if err := WriteExampleConfig(cliInputs.Config); err != nil {
+			log.WithFields(log.Fields{
+				"op":    "WriteExampleConfig",
+				"error": err,
+			}).Fatal("failed to write example config")
+		}
+		log.WithFields(log.Fields{
+			"op":     "main",
+			"config": cliInputs.Config,
+		}).Info("wrote example config")
+		os.Exit(0)
+	}
+
+	if cliInputs.Daemon && (cliInputs.Force || cliInputs.Deadline > 0) {
+		log.WithFields(log.Fields{
+			"op": "main",
+		}).Fatal("-daemon cannot be combined with -force or -deadline")
+	}
+
+	if cliInputs.Deadline > 0 {
+		time.AfterFunc(cliInputs.Deadline, func() {
+			log.WithFields(log.Fields{
+				"op":       "main",
+				"deadline": cliInputs.Deadline,
+			}).Error("deadline exceeded, exiting")
+			os.Exit(deadlineExitCode)
+		})
+	}
+
 	if cliInputs.Action != "start" && cliInputs.Action != "stop" {
 		log.WithFields(log.Fields{
 			"op": "main",
 		}).Fatal("CLI parameter action must be either start or stop")
 	}
 
-	configuration, err := LoadConfiguration(cliInputs.Config)
+	if cliInputs.AsOf != "" {
+		if _, err := time.Parse(time.RFC3339, cliInputs.AsOf); err != nil {
+			log.WithFields(log.Fields{
+				"op":    "main",
+				"error": err,
+			}).Fatal("CLI parameter as-of must be an RFC3339 time")
+		}
+	}
+
+	configuration, err := LoadConfiguration(cliInputs.Config, cliInputs.ConfigType, cliInputs.TemplateConfig)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"op":    "LoadConfiguration",
@@ -132,146 +947,98 @@ func main() {
 		}).Fatal("failed to parse configuration")
 	}
 
-	influxClient, queryAPI, err := InfluxConnect(configuration)
-	if err != nil {
+	applyCliOverrides(configuration, cliInputs, flags)
+
+	if err := configuration.Validate(); err != nil {
 		log.WithFields(log.Fields{
-			"op":    "influxdb.Connect",
+			"op":    "Configuration.Validate",
 			"error": err,
-		}).Fatal("failed to authenticate to InfluxDB")
+		}).Fatal("invalid configuration")
 	}
-	defer influxClient.Close()
 
-	var bucket string
-	if configuration.InfluxDB.Bucket != "" {
-		bucket = configuration.InfluxDB.Bucket
-	} else if configuration.InfluxDB.Database != "" && configuration.InfluxDB.RetentionPolicy != "" {
-		bucket = fmt.Sprintf("%s/%s", configuration.InfluxDB.Database, configuration.InfluxDB.RetentionPolicy)
-	} else {
+	if err := ConfigureLogging(configuration.Logging); err != nil {
 		log.WithFields(log.Fields{
-			"op":    "main",
+			"op":    "ConfigureLogging",
 			"error": err,
-		}).Fatal("must configure at least one of bucket or database/retention policy")
+		}).Fatal("failed to configure logging")
 	}
 
-	var pastPrecip float64
-	var futurePrecip float64
-	if cliInputs.Action == "start" {
-		// Query past precipitation
-		query := fmt.Sprintf(`from(bucket: "%s")
-			|> range(start: -%s)
-			|> filter(fn: (r) => r["_measurement"] == "%s" and r["_field"] == "%s")
-			|> max(column: "_value")`,
-			bucket, configuration.Query.LookbackDuration,
-			configuration.InfluxDB.Measurement, configuration.InfluxDB.Field)
-
-		result, err := queryAPI.Query(context.Background(), query)
-
-		if err != nil {
+	if cliInputs.History {
+		if configuration.History.Path == "" {
 			log.WithFields(log.Fields{
-				"op":    "main",
+				"op": "main",
+			}).Fatal("history.path must be set to print the history")
+		}
+		if err := PrintHistory(configuration.History.Path, cliInputs.HistoryLimit, os.Stdout); err != nil {
+			log.WithFields(log.Fields{
+				"op":    "PrintHistory",
 				"error": err,
-			}).Fatal("failed to query lookback data from InfluxDB")
+			}).Fatal("failed to print history")
 		}
+		os.Exit(0)
+	}
 
-		result.Next()
-		if result.Err() != nil {
+	if cliInputs.PrintQuery {
+		if err := PrintQueries(configuration, os.Stdout); err != nil {
 			log.WithFields(log.Fields{
-				"op":    "main",
+				"op":    "PrintQueries",
 				"error": err,
-			}).Fatal("failed parsing lookback data from InfluxDB")
+			}).Fatal("failed to print queries")
 		}
-		pastPrecip = result.Record().Value().(float64)
-		result.Close()
+		os.Exit(0)
 	}
 
-	// Query future data
-	query := fmt.Sprintf(`import "experimental"
-		from(bucket: "%s")
-			|> range(start: now(), stop: experimental.addDuration(d: %s, to: now()))
-			|> filter(fn: (r) => r["_measurement"] == "%s" and r["_field"] == "%s")
-			|> max(column: "_value")`,
-		bucket, configuration.Query.LookforwardDuration,
-		configuration.InfluxDB.Measurement, configuration.InfluxDB.Field)
-
-	result, err := queryAPI.Query(context.Background(), query)
-
-	if err != nil {
-		log.WithFields(log.Fields{
-			"op":    "main",
-			"error": err,
-		}).Fatal("failed to query lookforward data from InfluxDB")
-	}
+	if cliInputs.Diagnostics {
+		source, err := NewSource(configuration)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"op":    "NewSource",
+				"error": err,
+			}).Fatal("failed to set up precipitation source")
+		}
+		defer source.Close()
 
-	result.Next()
-	if result.Err() != nil {
-		log.WithFields(log.Fields{
-			"op":    "main",
-			"error": err,
-		}).Fatal("failed parsing lookforward data from InfluxDB")
+		if err := RunDiagnostics(context.Background(), configuration, source, os.Stdout); err != nil {
+			log.WithFields(log.Fields{
+				"op":    "RunDiagnostics",
+				"error": err,
+			}).Fatal("failed to run diagnostics")
+		}
+		os.Exit(0)
 	}
-	futurePrecip = result.Record().Value().(float64)
-	result.Close()
 
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: configuration.Vacuum.SkipVerifySsl}
+	// Every other outbound request goes through the default transport
+	http.DefaultTransport = withRetries(&headerTransport{
+		base: http.DefaultTransport,
+	}, configuration.HTTP)
 
-	// Conditionally launch robot vacuum
-	if cliInputs.Action == "start" {
-		if pastPrecip == 0.0 && futurePrecip == 0.0 {
-			_, err := http.Get(configuration.Vacuum.WebhookStart)
+	if cliInputs.Daemon {
+		reload := func() (*Configuration, error) {
+			reloaded, err := LoadConfiguration(cliInputs.Config, cliInputs.ConfigType, cliInputs.TemplateConfig)
 			if err != nil {
-				log.WithFields(log.Fields{
-					"op":    "main",
-					"error": err,
-				}).Fatal("failed to start robot vacuum")
-			} else {
-				log.WithFields(log.Fields{
-					"op":                  "main",
-					"lookbackDuration":    configuration.Query.LookbackDuration,
-					"lookforwardDuration": configuration.Query.LookforwardDuration,
-				}).Info("started robot vacuum based on no precipitation in forecast")
+				return nil, err
 			}
-		} else if pastPrecip > 0.0 && futurePrecip > 0.0 {
-			log.WithFields(log.Fields{
-				"op":                  "main",
-				"lookbackDuration":    configuration.Query.LookbackDuration,
-				"lookforwardDuration": configuration.Query.LookforwardDuration,
-			}).Info("precipitation found both in past and future forecast, not starting vacuum")
-		} else if pastPrecip > 0.0 {
-			log.WithFields(log.Fields{
-				"op":                  "main",
-				"lookbackDuration":    configuration.Query.LookbackDuration,
-				"lookforwardDuration": configuration.Query.LookforwardDuration,
-			}).Info("precipitation found in past weather, not starting vacuum")
-		} else if futurePrecip > 0.0 {
+			applyCliOverrides(reloaded, cliInputs, flags)
+			if err := reloaded.Validate(); err != nil {
+				return nil, err
+			}
+			return reloaded, nil
+		}
+		if err := RunDaemon(configuration, cliInputs, reload); err != nil {
 			log.WithFields(log.Fields{
-				"op":                  "main",
-				"lookbackDuration":    configuration.Query.LookbackDuration,
-				"lookforwardDuration": configuration.Query.LookforwardDuration,
-			}).Info("precipitation found in future forecast, not starting vacuum")
+				"op":    "RunDaemon",
+				"error": err,
+			}).Fatal("daemon failed")
 		}
+		os.Exit(0)
 	}
 
-	// Conditionally stop robot vacuum
-	if cliInputs.Action == "stop" {
-		if futurePrecip > 0.0 {
-			_, err := http.Get(configuration.Vacuum.WebhookStop)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"op":    "main",
-					"error": err,
-				}).Fatal("failed to stop robot vacuum")
-			} else {
-				log.WithFields(log.Fields{
-					"op":                  "main",
-					"lookforwardDuration": configuration.Query.LookforwardDuration,
-				}).Info("stopped robot vacuum based on precipitation in forecast")
-			}
-		} else {
-			log.WithFields(log.Fields{
-				"op":                  "main",
-				"lookforwardDuration": configuration.Query.LookforwardDuration,
-			}).Info("forecast is dry, not stopping vacuum")
-		}
+	if err := EvaluateDevices(context.Background(), configuration, cliInputs, nil); err != nil {
+		log.WithFields(log.Fields{
+			"op":    "main",
+			"error": err,
+		}).Fatal("evaluation failed")
 	}
 
 	os.Exit(0)
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Decisions counted by the daemon metrics
+const (
+	metricsDecisionStarted = "started"
+	metricsDecisionStopped = "stopped"
+	metricsDecisionSkipped = "skipped"
+)
+
+// Metrics accumulates the outcome of every run of the daemon for its
+// /metrics endpoint. Series are labelled with the action, and the device when
+// several are configured, so their runs can be told apart.
+type Metrics struct {
+	mu              sync.Mutex
+	decisions       map[string]map[string]int
+	queryFailures   map[string]int
+	webhookFailures map[string]int
+	pastPrecip      map[string]float64
+	futurePrecip    map[string]float64
+	lastDecision    map[string]time.Time
+}
+
+// NewMetrics returns empty daemon metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		decisions:       make(map[string]map[string]int),
+		queryFailures:   make(map[string]int),
+		webhookFailures: make(map[string]int),
+		pastPrecip:      make(map[string]float64),
+		futurePrecip:    make(map[string]float64),
+		lastDecision:    make(map[string]time.Time),
+	}
+}
+
+// metricsLabels renders the labels identifying the runs of a summary; the
+// series are keyed by them.
+func metricsLabels(summary RunSummary) string {
+	labels := fmt.Sprintf("action=%q", summary.Action)
+	if summary.Device != "" {
+		labels += fmt.Sprintf(",device=%q", summary.Device)
+	}
+	return labels
+}
+
+// Record counts the outcome of a run. A run failing before it reached a
+// decision counts as a query failure, one failing to command the vacuum as a
+// webhook failure.
+func (m *Metrics) Record(summary RunSummary, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := metricsLabels(summary)
+	switch {
+	case errors.Is(err, ErrWebhook):
+		m.webhookFailures[labels]++
+	case err != nil && summary.ReasonCode == "":
+		m.queryFailures[labels]++
+	}
+	if err != nil || summary.ReasonCode == "" {
+		return
+	}
+
+	decision := metricsDecisionSkipped
+	if summary.Act && summary.Action == "stop" {
+		decision = metricsDecisionStopped
+	} else if summary.Act {
+		decision = metricsDecisionStarted
+	}
+	if m.decisions[labels] == nil {
+		m.decisions[labels] = make(map[string]int)
+	}
+	m.decisions[labels][decision]++
+	m.pastPrecip[labels] = summary.PastPrecip
+	m.futurePrecip[labels] = summary.FuturePrecip
+	m.lastDecision[labels] = summary.Timestamp
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var buf bytes.Buffer
+	header := func(name string, kind string, help string) {
+		fmt.Fprintf(&buf, "# HELP %s%s %s\n# TYPE %s%s %s\n", prometheusPrefix, name, help, prometheusPrefix, name, kind)
+	}
+	sample := func(name string, labels string, value float64) {
+		fmt.Fprintf(&buf, "%s%s{%s} %s\n", prometheusPrefix, name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	header("decisions_total", "counter", "Decisions made by the daemon.")
+	for _, labels := range sortedKeys(m.decisions) {
+		for _, decision := range sortedKeys(m.decisions[labels]) {
+			sample("decisions_total", fmt.Sprintf("%s,decision=%q", labels, decision), float64(m.decisions[labels][decision]))
+		}
+	}
+	header("query_failures_total", "counter", "Runs failing before a decision was made.")
+	for _, labels := range sortedKeys(m.queryFailures) {
+		sample("query_failures_total", labels, float64(m.queryFailures[labels]))
+	}
+	header("webhook_failures_total", "counter", "Runs failing to command the vacuum.")
+	for _, labels := range sortedKeys(m.webhookFailures) {
+		sample("webhook_failures_total", labels, float64(m.webhookFailures[labels]))
+	}
+	header("past_precipitation", "gauge", "Precipitation over the lookback window at the last decision.")
+	for _, labels := range sortedKeys(m.pastPrecip) {
+		sample("past_precipitation", labels, m.pastPrecip[labels])
+	}
+	header("future_precipitation", "gauge", "Precipitation over the lookforward window at the last decision.")
+	for _, labels := range sortedKeys(m.futurePrecip) {
+		sample("future_precipitation", labels, m.futurePrecip[labels])
+	}
+	header("last_decision_timestamp_seconds", "gauge", "Time of the last decision.")
+	for _, labels := range sortedKeys(m.lastDecision) {
+		sample("last_decision_timestamp_seconds", labels, float64(m.lastDecision[labels].UnixNano())/1e9)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// ServeMetrics listens on the address and serves the metrics on /metrics and
+// on-demand evaluations on /evaluate until the context is done. Failing to
+// listen is returned immediately.
+func ServeMetrics(ctx context.Context, address string, metrics *Metrics, evaluate http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("unable to listen on metrics address %s, %s", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.Handle("/evaluate", evaluate)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithFields(log.Fields{
+				"op":    "ServeMetrics",
+				"error": err,
+			}).Error("metrics server failed")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return nil
+}
+
+// sortedKeys returns the keys of the map in order, for stable output.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
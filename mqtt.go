@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"strings"
+	"time"
+)
+
+// defaultMQTTTimeout bounds connecting and publishing when Vacuum.Timeout is
+// not set
+const defaultMQTTTimeout = 30 * time.Second
+
+// MQTT holds the broker and messages for commanding the vacuum over MQTT,
+// e.g. Valetudo's valetudo/{{.ID}}/BasicControlCapability/operation/set
+type MQTT struct {
+	Broker   string
+	Username string
+	Password string
+	ClientID string
+	QoS      byte
+	Retain   bool
+	Start    MQTTMessage
+	Stop     MQTTMessage
+	Return   MQTTMessage
+}
+
+// MQTTMessage is a payload published to a topic. Both are templates rendered
+// per vacuum ID like webhook URLs; the payload also sees the decision like
+// webhook bodies.
+type MQTTMessage struct {
+	Topic   string
+	Payload string
+}
+
+// StopMessage returns the message stopping the vacuum, or sending it back to
+// base when ReturnToBase is set.
+func (v Vacuum) StopMessage() MQTTMessage {
+	if v.ReturnToBase {
+		return v.MQTT.Return
+	}
+	return v.MQTT.Stop
+}
+
+// PublishMQTT connects to the broker and publishes the message once per
+// vacuum ID. Every vacuum is attempted even if an earlier one fails.
+func PublishMQTT(config *Configuration, message MQTTMessage, data WebhookData) (string, error) {
+	topics, err := WebhookURLs(config, message.Topic)
+	if err != nil {
+		return "", err
+	}
+	payloads, err := WebhookBodies(config, message.Payload, data)
+	if err != nil {
+		return "", err
+	}
+
+	timeout := config.Vacuum.Timeout
+	if timeout == 0 {
+		timeout = defaultMQTTTimeout
+	}
+	settings := config.Vacuum.MQTT
+	clientID := settings.ClientID
+	if clientID == "" {
+		clientID = fmt.Sprintf("outdoor-robovac-trigger-%d", time.Now().UnixNano())
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(settings.Broker).
+		SetClientID(clientID).
+		SetUsername(settings.Username).
+		SetPassword(settings.Password).
+		SetConnectTimeout(timeout).
+		SetAutoReconnect(false).
+		SetTLSConfig(&tls.Config{InsecureSkipVerify: config.Vacuum.SkipVerifySsl})
+
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return "", fmt.Errorf("timed out connecting to mqtt broker %s", settings.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return "", fmt.Errorf("unable to connect to mqtt broker %s, %s", settings.Broker, err)
+	}
+	defer client.Disconnect(250)
+
+	var published []string
+	var failures []string
+	for i, topic := range topics {
+		token := client.Publish(topic, settings.QoS, settings.Retain, payloads[i])
+		if !token.WaitTimeout(timeout) {
+			failures = append(failures, fmt.Sprintf("%s: timed out", topic))
+			continue
+		}
+		if err := token.Error(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", topic, err))
+			continue
+		}
+		published = append(published, fmt.Sprintf("published %s to %s", payloads[i], topic))
+	}
+
+	if len(failures) > 0 {
+		return strings.Join(published, "\n"), fmt.Errorf("mqtt publish failed for %s", strings.Join(failures, "; "))
+	}
+	return strings.Join(published, "\n"), nil
+}
+
+// validateMQTT checks the broker settings and message templates when the
+// vacuum is commanded over MQTT.
+func validateMQTT(c *Configuration) error {
+	settings := c.Vacuum.MQTT
+	if settings.Broker == "" {
+		return fmt.Errorf("mqtt.broker must be set when the vacuum protocol is mqtt")
+	}
+	if settings.Start.Topic == "" {
+		return fmt.Errorf("mqtt.start.topic must be set when the vacuum protocol is mqtt")
+	}
+	if settings.QoS > 2 {
+		return fmt.Errorf("mqtt.qos must be 0, 1 or 2")
+	}
+	if c.Vacuum.ReturnToBase && settings.Return.Topic == "" {
+		return fmt.Errorf("mqtt.return.topic must be set when returnToBase is enabled")
+	}
+	for _, message := range []MQTTMessage{settings.Start, settings.Stop, settings.Return} {
+		if _, err := WebhookURLs(c, message.Topic); err != nil {
+			return err
+		}
+		if _, err := WebhookBodies(c, message.Payload, WebhookData{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default endpoints of the notification services
+const (
+	pushoverURL = "https://api.pushover.net/1/messages.json"
+	telegramURL = "https://api.telegram.org"
+)
+
+// defaultSMTPPort is the mail submission port used when Email.Port is unset
+const defaultSMTPPort = 587
+
+// Pushover holds the parameters for sending notifications through Pushover
+type Pushover struct {
+	Token    string
+	User     string
+	Priority int
+	URL      string
+}
+
+// Telegram holds the parameters for sending notifications through a
+// Telegram bot
+type Telegram struct {
+	Token  string
+	ChatID string
+	URL    string
+}
+
+// Slack holds the incoming webhook receiving Slack notifications
+type Slack struct {
+	WebhookURL string
+}
+
+// Email holds the SMTP server and addresses for email notifications
+type Email struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// notificationSender sends a notification through one service
+type notificationSender struct {
+	name string
+	send func(config *Configuration, title string, body string) error
+}
+
+// notificationSenders returns the senders of every configured service.
+func notificationSenders(notify Notify) []notificationSender {
+	var senders []notificationSender
+	if notify.AppriseURL != "" {
+		senders = append(senders, notificationSender{name: "apprise", send: sendApprise})
+	}
+	if notify.Pushover.Token != "" {
+		senders = append(senders, notificationSender{name: "pushover", send: sendPushover})
+	}
+	if notify.Telegram.Token != "" {
+		senders = append(senders, notificationSender{name: "telegram", send: sendTelegram})
+	}
+	if notify.Slack.WebhookURL != "" {
+		senders = append(senders, notificationSender{name: "slack", send: sendSlack})
+	}
+	if notify.Email.Host != "" {
+		senders = append(senders, notificationSender{name: "email", send: sendEmail})
+	}
+	return senders
+}
+
+// sendApprise posts the notification to the Apprise notify API.
+func sendApprise(config *Configuration, title string, body string) error {
+	return postJSON(config, config.Notify.AppriseURL, apprisePayload{Title: title, Body: body})
+}
+
+// sendPushover posts the notification to the Pushover messages API.
+func sendPushover(config *Configuration, title string, body string) error {
+	settings := config.Notify.Pushover
+	url := settings.URL
+	if url == "" {
+		url = pushoverURL
+	}
+	return postJSON(config, url, map[string]interface{}{
+		"token":    settings.Token,
+		"user":     settings.User,
+		"title":    title,
+		"message":  body,
+		"priority": settings.Priority,
+	})
+}
+
+// sendTelegram sends the notification as a message from the bot. The bot
+// token is part of the URL, so it is removed from errors.
+func sendTelegram(config *Configuration, title string, body string) error {
+	settings := config.Notify.Telegram
+	base := settings.URL
+	if base == "" {
+		base = telegramURL
+	}
+	err := postJSON(config, strings.TrimSuffix(base, "/")+"/bot"+settings.Token+"/sendMessage", map[string]string{
+		"chat_id": settings.ChatID,
+		"text":    title + "\n" + body,
+	})
+	if err != nil {
+		return fmt.Errorf("%s", strings.ReplaceAll(err.Error(), settings.Token, "***"))
+	}
+	return nil
+}
+
+// sendSlack posts the notification to the Slack incoming webhook.
+func sendSlack(config *Configuration, title string, body string) error {
+	return postJSON(config, config.Notify.Slack.WebhookURL, map[string]string{
+		"text": "*" + title + "*\n" + body,
+	})
+}
+
+// sendEmail mails the notification through the SMTP server, upgrading the
+// connection with STARTTLS when the server offers it. Authentication is only
+// attempted when a username is set.
+func sendEmail(config *Configuration, title string, body string) error {
+	settings := config.Notify.Email
+	port := settings.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+	var auth smtp.Auth
+	if settings.Username != "" {
+		auth = smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		settings.From, strings.Join(settings.To, ", "), title, time.Now().Format(time.RFC1123Z), body)
+	address := net.JoinHostPort(settings.Host, strconv.Itoa(port))
+	if err := smtp.SendMail(address, auth, settings.From, settings.To, []byte(message)); err != nil {
+		return fmt.Errorf("unable to send email through %s, %s", address, err)
+	}
+	return nil
+}
+
+// validateNotificationSenders checks that every configured service has the
+// settings it needs.
+func validateNotificationSenders(notify Notify) error {
+	if notify.Pushover.Token != "" && notify.Pushover.User == "" {
+		return fmt.Errorf("notify.pushover.user must be set when notifying through pushover")
+	}
+	if notify.Pushover.Priority < -2 || notify.Pushover.Priority > 1 {
+		return fmt.Errorf("notify.pushover.priority must be between -2 and 1")
+	}
+	if notify.Telegram.Token != "" && notify.Telegram.ChatID == "" {
+		return fmt.Errorf("notify.telegram.chatId must be set when notifying through telegram")
+	}
+	if notify.Email.Host != "" && (notify.Email.From == "" || len(notify.Email.To) == 0) {
+		return fmt.Errorf("notify.email.from and notify.email.to must be set when notifying by email")
+	}
+	return nil
+}
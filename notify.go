@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"slices"
+)
+
+// Events that can trigger a notification
+const (
+	NotifyOnAction = "action"
+	NotifyOnSkip   = "skip"
+	NotifyOnError  = "error"
+)
+
+// defaultNotifyTitle is the notification title used when Notify.Title is unset
+const defaultNotifyTitle = "outdoor-robovac-trigger"
+
+// apprisePayload is the body accepted by the Apprise notify API
+type apprisePayload struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// NotifyEvent classifies a run summary as one of the notification events.
+func NotifyEvent(summary RunSummary) string {
+	switch {
+	case summary.Error != "":
+		return NotifyOnError
+	case summary.WebhookFired:
+		return NotifyOnAction
+	}
+	return NotifyOnSkip
+}
+
+// unqueriedReasons are the decisions taken before the precipitation was
+// queried, whose notification leaves out the precipitation
+var unqueriedReasons = []string{ReasonForced, ReasonSevereWeather, ReasonOutsideWindow, ReasonStaleData, ReasonFailsafe}
+
+// SendNotification sends the run outcome through every configured service
+// when the run matches one of the configured Notify.On events, which default
+// to action only. Every service is attempted even if an earlier one fails.
+func SendNotification(config *Configuration, summary RunSummary) error {
+	on := config.Notify.On
+	if len(on) == 0 {
+		on = []string{NotifyOnAction}
+	}
+	if !slices.Contains(on, NotifyEvent(summary)) {
+		return nil
+	}
+
+	title := config.Notify.Title
+	if title == "" {
+		title = defaultNotifyTitle
+	}
+	body := NotificationBody(config, summary)
+
+	var errs []error
+	for _, sender := range notificationSenders(config.Notify) {
+		if err := sender.send(config, title, body); err != nil {
+			errs = append(errs, fmt.Errorf("%s, %s", sender.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NotificationBody describes the run outcome, e.g. "precipitation found in
+// future forecast, not starting vacuum (past 0 over 1d, future 3 over 6h)".
+func NotificationBody(config *Configuration, summary RunSummary) string {
+	body := summary.Reason
+	switch {
+	case summary.Error != "":
+		body = fmt.Sprintf("%s failed, %s", summary.Action, summary.Error)
+	case slices.Contains(unqueriedReasons, summary.ReasonCode):
+	case summary.Action == "start":
+		body += fmt.Sprintf(" (past %v over %s, future %v over %s)", summary.PastPrecip, config.Query.LookbackDuration,
+			summary.FuturePrecip, config.Query.LookforwardDuration)
+	default:
+		body += fmt.Sprintf(" (future %v over %s)", summary.FuturePrecip, config.Query.LookforwardDuration)
+	}
+	if summary.Device != "" {
+		body = summary.Device + ": " + body
+	}
+	return body
+}
+
+// DecisionChanged records whether the run decided to act in the state file
+// and reports whether that differs from the previous run of the same action.
+// The first recorded run counts as a change. Failed runs reached no decision
+// and are neither recorded nor compared.
+func DecisionChanged(config *Configuration, summary RunSummary, logger *log.Entry) (bool, error) {
+	if summary.Error != "" {
+		return true, nil
+	}
+	state, err := LoadState(config.StateFile)
+	if err != nil {
+		return true, err
+	}
+
+	previous, recorded := state.LastAct[summary.Action]
+	changed := !recorded || previous != summary.Act
+	if !changed {
+		return false, nil
+	}
+	if recorded {
+		logger.WithFields(log.Fields{
+			"op":       "DecisionChanged",
+			"action":   summary.Action,
+			"previous": previous,
+			"act":      summary.Act,
+		}).Info("decision changed since the previous run")
+	}
+
+	if state.LastAct == nil {
+		state.LastAct = make(map[string]bool)
+	}
+	state.LastAct[summary.Action] = summary.Act
+	return true, state.Save(config.StateFile)
+}
+
+// validateNotify checks the configured notification events.
+func validateNotify(notify Notify) error {
+	for _, event := range notify.On {
+		switch event {
+		case NotifyOnAction, NotifyOnSkip, NotifyOnError:
+		default:
+			return fmt.Errorf("unknown notification event %s", event)
+		}
+	}
+	return validateNotificationSenders(notify)
+}
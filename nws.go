@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nwsURL is the base of the National Weather Service API
+const nwsURL = "https://api.weather.gov"
+
+// defaultNWSUserAgent identifies the program to the NWS API, which rejects
+// requests without a User-Agent
+const defaultNWSUserAgent = "outdoor-robovac-trigger"
+
+// nwsPoint is the response of the points endpoint locating the forecast grid
+type nwsPoint struct {
+	Properties struct {
+		ForecastGridData string `json:"forecastGridData"`
+	} `json:"properties"`
+}
+
+// nwsLayer is a time series of the gridpoint forecast; each value covers an
+// ISO 8601 interval such as 2024-05-01T06:00:00+00:00/PT6H
+type nwsLayer struct {
+	Values []struct {
+		ValidTime string   `json:"validTime"`
+		Value     *float64 `json:"value"`
+	} `json:"values"`
+}
+
+// nwsGridData is the gridpoint forecast response
+type nwsGridData struct {
+	Properties struct {
+		QuantitativePrecipitation  nwsLayer `json:"quantitativePrecipitation"`
+		ProbabilityOfPrecipitation nwsLayer `json:"probabilityOfPrecipitation"`
+	} `json:"properties"`
+}
+
+// nwsHeaders returns the headers sent with every NWS request.
+func nwsHeaders(forecast Forecast) map[string]string {
+	userAgent := forecast.UserAgent
+	if userAgent == "" {
+		userAgent = defaultNWSUserAgent
+	}
+	return map[string]string{"User-Agent": userAgent, "Accept": "application/geo+json"}
+}
+
+// nwsGridURL looks up the forecast grid covering the configured coordinates.
+// The grid of a location does not change, so the lookup is cached in the
+// state file when one is configured.
+func nwsGridURL(config *Configuration) (string, error) {
+	key := fmt.Sprintf("%.4f,%.4f", config.Forecast.Latitude, config.Forecast.Longitude)
+	var state *State
+	if config.StateFile != "" {
+		var err error
+		if state, err = LoadState(config.StateFile); err != nil {
+			return "", err
+		}
+		if url, ok := state.NWSGridpoints[key]; ok {
+			return url, nil
+		}
+	}
+
+	base := config.Forecast.URL
+	if base == "" {
+		base = nwsURL
+	}
+	var point nwsPoint
+	if err := getJSON(base+"/points/"+key, nwsHeaders(config.Forecast), config.Forecast.Timeout, &point); err != nil {
+		return "", fmt.Errorf("nws gridpoint lookup failed, %s", err)
+	}
+	url := point.Properties.ForecastGridData
+	if url == "" {
+		return "", fmt.Errorf("nws returned no forecast grid for %s", key)
+	}
+
+	if state != nil {
+		if state.NWSGridpoints == nil {
+			state.NWSGridpoints = make(map[string]string)
+		}
+		state.NWSGridpoints[key] = url
+		if err := state.Save(config.StateFile); err != nil {
+			return "", err
+		}
+	}
+	return url, nil
+}
+
+// fetchNWS loads the quantitative precipitation forecast in mm as hourly
+// points, spreading the amount of each multi-hour period evenly over its
+// hours. Periods whose probability of precipitation is below
+// Forecast.MinProbability count as dry.
+func fetchNWS(config *Configuration, gridURL string) ([]precipPoint, error) {
+	grid, err := fetchNWSGridData(config, gridURL)
+	if err != nil {
+		return nil, err
+	}
+	probability, err := nwsHourlyProbability(grid)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []precipPoint
+	for _, entry := range grid.Properties.QuantitativePrecipitation.Values {
+		if entry.Value == nil {
+			continue
+		}
+		start, hours, err := parseNWSValidTime(entry.ValidTime)
+		if err != nil {
+			return nil, err
+		}
+		for h := 0; h < hours; h++ {
+			hour := start.Add(time.Duration(h) * time.Hour)
+			value := *entry.Value / float64(hours)
+			if pop, ok := probability[hour]; ok && pop < config.Forecast.MinProbability {
+				value = 0
+			}
+			points = append(points, precipPoint{time: hour, value: value})
+		}
+	}
+	return points, nil
+}
+
+// fetchNWSProbability loads the probability of precipitation in percent as
+// hourly points.
+func fetchNWSProbability(config *Configuration, gridURL string) ([]precipPoint, error) {
+	grid, err := fetchNWSGridData(config, gridURL)
+	if err != nil {
+		return nil, err
+	}
+	probability, err := nwsHourlyProbability(grid)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]precipPoint, 0, len(probability))
+	for hour, value := range probability {
+		points = append(points, precipPoint{time: hour, value: value})
+	}
+	return points, nil
+}
+
+// fetchNWSGridData requests the gridpoint forecast.
+func fetchNWSGridData(config *Configuration, gridURL string) (nwsGridData, error) {
+	var grid nwsGridData
+	if err := getJSON(gridURL, nwsHeaders(config.Forecast), config.Forecast.Timeout, &grid); err != nil {
+		return nwsGridData{}, fmt.Errorf("nws forecast request failed, %s", err)
+	}
+	return grid, nil
+}
+
+// nwsHourlyProbability maps each hour of the forecast to the probability of
+// precipitation of the period covering it.
+func nwsHourlyProbability(grid nwsGridData) (map[time.Time]float64, error) {
+	probability := make(map[time.Time]float64)
+	for _, entry := range grid.Properties.ProbabilityOfPrecipitation.Values {
+		if entry.Value == nil {
+			continue
+		}
+		start, hours, err := parseNWSValidTime(entry.ValidTime)
+		if err != nil {
+			return nil, err
+		}
+		for h := 0; h < hours; h++ {
+			probability[start.Add(time.Duration(h)*time.Hour)] = *entry.Value
+		}
+	}
+	return probability, nil
+}
+
+// parseNWSValidTime splits an ISO 8601 interval of a start time and a
+// duration in days and hours, e.g. 2024-05-01T06:00:00+00:00/P1DT6H, into
+// the start and the number of hours.
+func parseNWSValidTime(validTime string) (time.Time, int, error) {
+	startText, duration, ok := strings.Cut(validTime, "/")
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("invalid nws validTime %s", validTime)
+	}
+	start, err := time.Parse(time.RFC3339, startText)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid nws validTime %s, %s", validTime, err)
+	}
+
+	rest, ok := strings.CutPrefix(duration, "P")
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("invalid nws validTime %s", validTime)
+	}
+	var hours int
+	days, rest, hasDays := strings.Cut(rest, "D")
+	if !hasDays {
+		rest = days
+	} else {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("invalid nws validTime %s", validTime)
+		}
+		hours += 24 * n
+	}
+	if rest != "" {
+		text, ok := strings.CutPrefix(rest, "T")
+		text, hasHours := strings.CutSuffix(text, "H")
+		n, err := strconv.Atoi(text)
+		if !ok || !hasHours || err != nil {
+			return time.Time{}, 0, fmt.Errorf("invalid nws validTime %s", validTime)
+		}
+		hours += n
+	}
+	if hours <= 0 {
+		return time.Time{}, 0, fmt.Errorf("invalid nws validTime %s", validTime)
+	}
+	return start, hours, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// openWeatherMapURL is the One Call API 3.0 endpoint
+const openWeatherMapURL = "https://api.openweathermap.org/data/3.0/onecall"
+
+// owmHour is an hourly entry of the One Call API; precipitation of the hour
+// is reported in mm under rain and snow, its probability as a fraction under
+// pop
+type owmHour struct {
+	Dt   int64              `json:"dt"`
+	Rain map[string]float64 `json:"rain"`
+	Snow map[string]float64 `json:"snow"`
+	Pop  float64            `json:"pop"`
+}
+
+// owmForecast is the One Call API response
+type owmForecast struct {
+	Hourly []owmHour `json:"hourly"`
+}
+
+// owmTimemachine is the One Call API response for a past hour
+type owmTimemachine struct {
+	Data []owmHour `json:"data"`
+}
+
+// point converts an hourly entry to a precipitation point.
+func (h owmHour) point() precipPoint {
+	return precipPoint{time: time.Unix(h.Dt, 0), value: h.Rain["1h"] + h.Snow["1h"]}
+}
+
+// owmParams returns the query parameters locating the configured coordinates.
+func owmParams(config *Configuration) url.Values {
+	return url.Values{
+		"lat":   {strconv.FormatFloat(config.Forecast.Latitude, 'f', -1, 64)},
+		"lon":   {strconv.FormatFloat(config.Forecast.Longitude, 'f', -1, 64)},
+		"units": {"metric"},
+		"appid": {config.Forecast.APIKey},
+	}
+}
+
+// owmBaseURL returns the configured One Call endpoint.
+func owmBaseURL(config *Configuration) string {
+	if config.Forecast.URL != "" {
+		return config.Forecast.URL
+	}
+	return openWeatherMapURL
+}
+
+// fetchOpenWeatherMap loads the hourly precipitation covering [start, stop).
+// The forecast comes from a single One Call request; the past is not part of
+// it, so each past hour is requested from the timemachine endpoint, costing
+// one API call per hour of lookback.
+func fetchOpenWeatherMap(config *Configuration, now time.Time, start time.Time, stop time.Time) ([]precipPoint, error) {
+	base := owmBaseURL(config)
+	params := owmParams(config)
+
+	var points []precipPoint
+	currentHour := now.Truncate(time.Hour)
+	for hour := start.Truncate(time.Hour); hour.Before(stop) && hour.Before(currentHour); hour = hour.Add(time.Hour) {
+		hourParams := url.Values{"dt": {strconv.FormatInt(hour.Unix(), 10)}}
+		for key, value := range params {
+			hourParams[key] = value
+		}
+		var past owmTimemachine
+		if err := getJSON(base+"/timemachine?"+hourParams.Encode(), nil, config.Forecast.Timeout, &past); err != nil {
+			return nil, fmt.Errorf("openweathermap history request failed, %s", err)
+		}
+		for _, entry := range past.Data {
+			points = append(points, entry.point())
+		}
+	}
+
+	if stop.After(currentHour) {
+		params.Set("exclude", "current,minutely,daily,alerts")
+		var forecast owmForecast
+		if err := getJSON(base+"?"+params.Encode(), nil, config.Forecast.Timeout, &forecast); err != nil {
+			return nil, fmt.Errorf("openweathermap forecast request failed, %s", err)
+		}
+		for _, entry := range forecast.Hourly {
+			points = append(points, entry.point())
+		}
+	}
+	return points, nil
+}
+
+// fetchOpenWeatherMapProbability loads the hourly probability of
+// precipitation in percent. It is only part of the forecast, so a single One
+// Call request covers it.
+func fetchOpenWeatherMapProbability(config *Configuration) ([]precipPoint, error) {
+	params := owmParams(config)
+	params.Set("exclude", "current,minutely,daily,alerts")
+	var forecast owmForecast
+	if err := getJSON(owmBaseURL(config)+"?"+params.Encode(), nil, config.Forecast.Timeout, &forecast); err != nil {
+		return nil, fmt.Errorf("openweathermap forecast request failed, %s", err)
+	}
+	points := make([]precipPoint, 0, len(forecast.Hourly))
+	for _, entry := range forecast.Hourly {
+		points = append(points, precipPoint{time: time.Unix(entry.Dt, 0), value: math.Round(entry.Pop * 100)})
+	}
+	return points, nil
+}
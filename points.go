@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Ways sources evaluated in Go reduce a window without WetInterval
+const (
+	AggregateMax = "max"
+	AggregateSum = "sum"
+)
+
+// precipPoint is a single timestamped precipitation reading
+type precipPoint struct {
+	time  time.Time
+	value float64
+}
+
+// pointSource computes the window values in Go from timestamped points, for
+// sources that are not queried through Flux. The points are loaded afresh
+// for each window; load is given the window so that sources fetching history
+// and forecast separately only request what is needed, while sources holding
+// every point may ignore it.
+type pointSource struct {
+	config    *Configuration
+	now       func() time.Time
+	origin    string
+	aggregate string
+	load      func(start time.Time, stop time.Time) ([]precipPoint, error)
+}
+
+// Lookback returns the maximum precipitation over the lookback window. The
+// points form a single series, so the threshold is not needed.
+func (s *pointSource) Lookback(ctx context.Context, threshold float64) (float64, error) {
+	start, stop, err := s.lookbackWindow()
+	if err != nil {
+		return 0, err
+	}
+	return s.window(start, stop)
+}
+
+// Lookforward returns the maximum precipitation over the lookforward window.
+func (s *pointSource) Lookforward(ctx context.Context, threshold float64) (float64, error) {
+	start, stop, err := s.lookforwardWindow()
+	if err != nil {
+		return 0, err
+	}
+	return s.window(start, stop)
+}
+
+// lookbackWindow returns the bounds of the lookback window ending now.
+func (s *pointSource) lookbackWindow() (time.Time, time.Time, error) {
+	lookback, err := ParseFluxDuration(s.config.Query.LookbackDuration)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	now, err := s.truncatedNow()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return now.Add(-lookback), now, nil
+}
+
+// lookforwardWindow returns the bounds of the lookforward window starting
+// LookforwardOffset from now.
+func (s *pointSource) lookforwardWindow() (time.Time, time.Time, error) {
+	lookforward, err := ParseFluxDuration(s.config.Query.LookforwardDuration)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	offset, err := ParseFluxDuration(s.config.Query.LookforwardOffset)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	now, err := s.truncatedNow()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start := now.Add(offset)
+	return start, start.Add(lookforward), nil
+}
+
+// truncatedNow returns the current time rounded down to Query.TruncateNow.
+func (s *pointSource) truncatedNow() (time.Time, error) {
+	unit, err := ParseFluxDuration(s.config.Query.TruncateNow)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.now().Truncate(unit), nil
+}
+
+// MinutesSinceRain returns how many minutes ago the last point with
+// precipitation above the threshold was, looking back Query.MinDrySince.
+// ErrNoData means it has been dry for at least that long.
+func (s *pointSource) MinutesSinceRain(ctx context.Context, threshold float64) (float64, error) {
+	within, err := ParseFluxDuration(s.config.Query.MinDrySince)
+	if err != nil {
+		return 0, err
+	}
+	now := s.now()
+	points, err := s.load(now.Add(-within), now)
+	if err != nil {
+		return 0, err
+	}
+
+	var last time.Time
+	for _, point := range points {
+		if point.value > threshold && point.time.After(last) && !point.time.Before(now.Add(-within)) && !point.time.After(now) {
+			last = point.time
+		}
+	}
+	if last.IsZero() {
+		return 0, fmt.Errorf("%w with precipitation in %s within %s", ErrNoData, s.origin, s.config.Query.MinDrySince)
+	}
+	return now.Sub(last).Minutes(), nil
+}
+
+// Close is a no-op for sources loading their points on demand.
+func (s *pointSource) Close() {}
+
+// window reduces the values with a timestamp in [start, stop) the same way
+// the Flux aggregation does: the maximum by default, or the significant
+// accumulation when WetInterval is set. Sources that aggregate by sum return
+// the total instead of the maximum.
+func (s *pointSource) window(start time.Time, stop time.Time) (float64, error) {
+	points, err := s.load(start, stop)
+	if err != nil {
+		return 0, err
+	}
+
+	interval, err := ParseFluxDuration(s.config.Query.WetInterval)
+	if err != nil {
+		return 0, err
+	}
+	every, err := ParseFluxDuration(s.config.Query.WindowEvery)
+	if err != nil {
+		return 0, err
+	}
+	if every > 0 {
+		points = downsample(points, start, stop, every)
+	}
+
+	var found bool
+	var maximum, total float64
+	intervalSums := make(map[time.Time]float64)
+	for _, point := range points {
+		if point.time.Before(start) || !point.time.Before(stop) {
+			continue
+		}
+		if !found || point.value > maximum {
+			maximum = point.value
+			found = true
+		}
+		total += point.value
+		if interval > 0 {
+			intervalSums[point.time.Truncate(interval)] += point.value
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("%w in %s between %s and %s", ErrNoData, s.origin,
+			start.Format(time.RFC3339), stop.Format(time.RFC3339))
+	}
+	if interval == 0 && s.aggregate == AggregateSum {
+		return total, nil
+	}
+	if interval == 0 {
+		return maximum, nil
+	}
+
+	var wet int64
+	for _, sum := range intervalSums {
+		if sum > 0 {
+			wet++
+		}
+	}
+	return SignificantPrecip(s.config.Query, total, wet)
+}
+
+// downsample replaces the points within [start, stop) by the mean of each
+// window of the given length.
+func downsample(points []precipPoint, start time.Time, stop time.Time, every time.Duration) []precipPoint {
+	sums := make(map[time.Time]float64)
+	counts := make(map[time.Time]int)
+	for _, point := range points {
+		if point.time.Before(start) || !point.time.Before(stop) {
+			continue
+		}
+		window := point.time.Truncate(every)
+		if window.Before(start) {
+			window = start
+		}
+		sums[window] += point.value
+		counts[window]++
+	}
+
+	downsampled := make([]precipPoint, 0, len(sums))
+	for window, sum := range sums {
+		downsampled = append(downsampled, precipPoint{time: window, value: sum / float64(counts[window])})
+	}
+	return downsampled
+}
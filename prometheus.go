@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// prometheusPrefix namespaces the metrics written to the textfile
+const prometheusPrefix = "outdoor_robovac_trigger_"
+
+// WritePrometheusFile writes the run summary in the Prometheus text exposition
+// format for the node_exporter textfile collector. The file is replaced
+// atomically so the collector never reads a partial file.
+func WritePrometheusFile(path string, summary RunSummary) error {
+	var buf bytes.Buffer
+	labels := fmt.Sprintf(`action=%q`, summary.Action)
+	if summary.Device != "" {
+		labels += fmt.Sprintf(`,device=%q`, summary.Device)
+	}
+	gauge := func(name string, help string, value float64) {
+		fmt.Fprintf(&buf, "# HELP %s%s %s\n# TYPE %s%s gauge\n%s%s{%s} %s\n",
+			prometheusPrefix, name, help, prometheusPrefix, name, prometheusPrefix, name, labels,
+			strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	gauge("last_run_timestamp_seconds", "Time the last run started.", float64(summary.Timestamp.UnixNano())/1e9)
+	gauge("last_run_duration_seconds", "Duration of the last run.", summary.Duration.Seconds())
+	gauge("last_run_success", "Whether the last run completed without error.", boolGauge(summary.Success))
+	gauge("act", "Whether the last run decided to take the action.", boolGauge(summary.Act))
+	gauge("webhook_fired", "Whether the last run fired the action webhook.", boolGauge(summary.WebhookFired))
+	gauge("past_precipitation", "Precipitation over the lookback window in the last run.", summary.PastPrecip)
+	gauge("future_precipitation", "Precipitation over the lookforward window in the last run.", summary.FuturePrecip)
+	fmt.Fprintf(&buf, "# HELP %sdecision Reason code of the last decision.\n# TYPE %sdecision gauge\n%sdecision{%s,reason_code=%q} 1\n",
+		prometheusPrefix, prometheusPrefix, prometheusPrefix, labels, summary.ReasonCode)
+
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing prometheus file, %s", err)
+	}
+	return nil
+}
+
+// boolGauge converts a bool to a gauge value.
+func boolGauge(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// NewestPoint returns the time of the most recent precipitation point
+// spanning the lookback and lookforward windows.
+func (s *InfluxSource) NewestPoint(ctx context.Context) (time.Time, error) {
+	result, err := s.queryAPI.Query(ctx, NewestPointQuery(s.config, s.bucket))
+	if err != nil {
+		return time.Time{}, queryError(err)
+	}
+	defer result.Close()
+
+	if !result.Next() {
+		if result.Err() != nil {
+			return time.Time{}, fmt.Errorf("failed parsing data from InfluxDB, %s", result.Err())
+		}
+		return time.Time{}, ErrNoData
+	}
+	return result.Record().Time(), nil
+}
+
+// EnsureFresh checks that the newest precipitation point is no older than
+// Query.MaxDataAge. When it is stale and a refresh webhook is configured the
+// webhook is called to trigger the weather poller and the data is checked
+// again after Query.RefreshWait. The wait ends early once ctx is done.
+func EnsureFresh(ctx context.Context, config *Configuration, source *InfluxSource, logger *log.Entry) (bool, error) {
+	fresh, newest, err := isFresh(ctx, config, source)
+	if err != nil || fresh || config.Query.RefreshWebhook == "" {
+		return fresh, err
+	}
+
+	logger.WithFields(log.Fields{
+		"op":     "EnsureFresh",
+		"newest": newest,
+		"wait":   config.Query.RefreshWait,
+	}).Info("precipitation data is stale, requesting a refresh")
+	response, err := CallWebhook(config, WebhookRequest{URL: config.Query.RefreshWebhook})
+	if err != nil {
+		return false, fmt.Errorf("refresh webhook failed, %s", err)
+	}
+	logger.WithFields(log.Fields{
+		"op":       "EnsureFresh",
+		"response": truncate(response, maxResponseLogLength),
+	}).Debug("refresh webhook called")
+	timer := time.NewTimer(config.Query.RefreshWait)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return false, fmt.Errorf("interrupted while waiting for the refresh, %w", ctx.Err())
+	case <-timer.C:
+	}
+
+	fresh, _, err = isFresh(ctx, config, source)
+	return fresh, err
+}
+
+// isFresh reports whether the newest precipitation point is recent enough,
+// along with its time. A window without any data counts as stale.
+func isFresh(ctx context.Context, config *Configuration, source *InfluxSource) (bool, time.Time, error) {
+	newest, err := source.NewestPoint(ctx)
+	if errors.Is(err, ErrNoData) {
+		return false, newest, nil
+	}
+	if err != nil {
+		return false, newest, fmt.Errorf("failed to query newest precipitation point, %w", err)
+	}
+	return time.Since(newest) <= config.Query.MaxDataAge, newest, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"time"
+)
+
+// HTTP holds the retry policy applied to every outbound HTTP request,
+// including webhooks, InfluxDB queries and API calls
+type HTTP struct {
+	Retries    int
+	Timeout    time.Duration
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Defaults for the delay between HTTP retries
+const (
+	defaultRetryBackoff    = time.Second
+	defaultMaxRetryBackoff = 30 * time.Second
+)
+
+// withRetries wraps the transport in the retry policy, or returns it as is
+// when neither retries nor a per-attempt timeout are configured.
+func withRetries(base http.RoundTripper, policy HTTP) http.RoundTripper {
+	if policy.Retries <= 0 && policy.Timeout <= 0 {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{base: base, policy: policy}
+}
+
+// retryTransport retries requests failing with a network error, 429 or a 5xx
+// status with exponential backoff, and bounds each attempt by the policy
+// timeout. A client timeout still bounds all attempts together.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy HTTP
+}
+
+// RoundTrip sends the request, retrying it per the policy. Requests whose
+// body cannot be replayed are sent once.
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.policy.Backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxBackoff := t.policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxRetryBackoff
+	}
+	retries := t.policy.Retries
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if t.policy.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(req.Context(), t.policy.Timeout)
+		} else {
+			ctx, cancel = context.WithCancel(req.Context())
+		}
+		resp, err := t.base.RoundTrip(attemptReq.WithContext(ctx))
+
+		retryable := req.Context().Err() == nil &&
+			(err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500)
+		if !retryable || attempt >= retries {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		fields := log.Fields{
+			"op":      "retryTransport",
+			"host":    req.URL.Host,
+			"attempt": attempt + 1,
+			"retries": retries,
+			"delay":   backoff,
+		}
+		if err != nil {
+			// The URL may carry a token, so only the cause is logged
+			var urlErr *neturl.Error
+			if errors.As(err, &urlErr) {
+				fields["error"] = urlErr.Err
+			} else {
+				fields["error"] = err
+			}
+		} else {
+			fields["status"] = resp.StatusCode
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+		log.WithFields(fields).Warn("HTTP request failed, retrying")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// cancelBody releases the context of a request attempt once its response body
+// is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the attempt's context.
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// defaultStatusMaxAge is how far back the vacuum status is looked up when
+// Vacuum.StatusMaxAge is unset
+const defaultStatusMaxAge = time.Hour
+
+// defaultSoilMoistureMaxAge is how far back the soil moisture is looked up
+// when SoilMoisture.MaxAge is unset
+const defaultSoilMoistureMaxAge = time.Hour
+
+// defaultSevereWeatherMaxAge is how far back the severe weather alert is
+// looked up when SevereWeather.MaxAge is unset
+const defaultSevereWeatherMaxAge = time.Hour
+
+// Run performs a single evaluation of the requested action: it queries the
+// precipitation source, decides whether to act and fires the webhook and
+// hooks if so. Any failure is returned so the whole evaluation can be
+// retried. Every run ends with a single summary log entry. When source is nil
+// one is set up for the run and closed afterwards; the daemon passes its
+// long-lived source so connections are reused between runs. Waits within the
+// run, such as the stop grace period, end early once ctx is done.
+func Run(ctx context.Context, config *Configuration, cliInputs CliInputs, source Source, logger *log.Entry) (err error) {
+	var pastPrecip float64
+	var futurePrecip float64
+	var decision Decision
+	var fired bool
+	started := time.Now()
+	defer func() {
+		summary := RunSummary{
+			Timestamp:     started,
+			CorrelationID: CorrelationID(),
+			Device:        config.device,
+			Action:        cliInputs.Action,
+			Success:       err == nil,
+			Act:           decision.Act,
+			ReasonCode:    decision.Code,
+			Reason:        decision.Reason,
+			PastPrecip:    pastPrecip,
+			FuturePrecip:  futurePrecip,
+			WebhookFired:  fired,
+			DryRun:        config.DryRun,
+			Duration:      time.Since(started),
+		}
+		if err != nil {
+			summary.Error = err.Error()
+		}
+		// Deciding without acting only reports the decision
+		if config.decideOnly {
+			if config.onSummary != nil {
+				config.onSummary(summary)
+			}
+			return
+		}
+		LogSummary(logger, cliInputs.Quiet, summary)
+		if config.metrics != nil {
+			config.metrics.Record(summary, err)
+		}
+		if config.onSummary != nil {
+			config.onSummary(summary)
+		}
+		if config.History.Path != "" {
+			if err := RecordHistory(config.History, summary); err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "RecordHistory",
+					"error": err,
+				}).Warn("failed to record history")
+			}
+		}
+		if cliInputs.MetricsJSON {
+			if err := WriteMetricsJSON(os.Stdout, summary); err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "WriteMetricsJSON",
+					"error": err,
+				}).Warn("failed to write metrics")
+			}
+		}
+		// A dry run neither notifies nor records the decision for
+		// onChangeOnly
+		notify := len(notificationSenders(config.Notify)) > 0 && !config.DryRun
+		if notify && config.Notify.OnChangeOnly {
+			changed, err := DecisionChanged(config, summary, logger)
+			if err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "DecisionChanged",
+					"error": err,
+				}).Warn("failed to record decision")
+			}
+			notify = changed
+		}
+		if notify {
+			if err := SendNotification(config, summary); err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "SendNotification",
+					"error": err,
+				}).Warn("failed to send notification")
+			}
+		}
+		if config.LineProtocol.URL != "" {
+			if err := PostDecisionLine(config, summary); err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "PostDecisionLine",
+					"error": err,
+				}).Warn("failed to post decision line protocol")
+			}
+		}
+		if config.PrometheusFile != "" {
+			if err := WritePrometheusFile(config.PrometheusFile, summary); err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "WritePrometheusFile",
+					"error": err,
+				}).Warn("failed to write prometheus file")
+			}
+		}
+		if config.EventWebhook != "" {
+			if err := PostEvent(config, summary); err != nil {
+				logger.WithFields(log.Fields{
+					"op":    "PostEvent",
+					"error": err,
+				}).Warn("failed to post event")
+			}
+		}
+		if config.EventSocket.Path != "" {
+			if socketErr := WriteEventSocket(config, summary); socketErr != nil {
+				logger.WithFields(log.Fields{
+					"op":    "WriteEventSocket",
+					"error": socketErr,
+				}).Warn("failed to write event socket")
+				// The action has already been taken, so another attempt
+				// must not repeat it
+				if err == nil && !config.EventSocket.Optional {
+					err = fmt.Errorf("failed to write event socket (%w), %s", ErrNotRetryable, socketErr)
+				}
+			}
+		}
+	}()
+
+	if cliInputs.Force {
+		decision = ForcedDecision(config.Vacuum, cliInputs.Action)
+		if err := ForceAction(config, cliInputs.Action, decision, logger); err != nil {
+			return err
+		}
+		fired = !config.DryRun
+		return nil
+	}
+
+	if source == nil {
+		source, err = NewSource(config)
+		if err != nil {
+			return fmt.Errorf("failed to set up precipitation source, %w", err)
+		}
+		defer source.Close()
+	}
+
+	// Skipped actions are demoted below the default log level in quiet mode
+	skipLevel := log.InfoLevel
+	if cliInputs.Quiet {
+		skipLevel = log.DebugLevel
+	}
+
+	// Starting is only permitted within the allowed windows, whatever the
+	// weather; stopping is always permitted
+	if cliInputs.Action == "start" {
+		allowed, err := InAllowedWindow(config.Schedule, time.Now())
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			decision = Decision{Code: ReasonOutsideWindow, Reason: "outside of the allowed run windows, not starting vacuum"}
+			logger.WithFields(log.Fields{
+				"op":             "Run",
+				"allowedWindows": config.Schedule.AllowedWindows,
+				"reason_code":    decision.Code,
+			}).Log(skipLevel, decision.Reason)
+			return nil
+		}
+	}
+
+	// The severe weather alert overrides everything else
+	if config.SevereWeather.Field != "" {
+		maxAge := config.SevereWeather.MaxAge
+		if maxAge <= 0 {
+			maxAge = defaultSevereWeatherMaxAge
+		}
+		value, err := source.(*InfluxSource).LatestValue(context.Background(), config.SevereWeather.Connection,
+			config.SevereWeather.Measurement, config.SevereWeather.Field, maxAge)
+		if err != nil && !errors.Is(err, ErrNoData) {
+			return fmt.Errorf("failed to query severe weather alert, %w", err)
+		}
+		if err == nil && SevereWeatherActive(value) {
+			decision = SevereWeatherDecision(cliInputs.Action)
+			if !decision.Act {
+				logger.WithFields(log.Fields{
+					"op":          "Run",
+					"reason_code": decision.Code,
+				}).Warn(decision.Reason)
+				return nil
+			}
+			if err := ForceAction(config, cliInputs.Action, decision, logger); err != nil {
+				return err
+			}
+			fired = !config.DryRun
+			return nil
+		}
+	}
+
+	if config.Query.MaxDataAge > 0 {
+		fresh, err := EnsureFresh(ctx, config, source.(*InfluxSource), logger)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			decision = Decision{Code: ReasonStaleData, Reason: fmt.Sprintf("precipitation data is older than %s, not taking %s action",
+				config.Query.MaxDataAge, cliInputs.Action)}
+			logger.WithFields(log.Fields{
+				"op":          "Run",
+				"reason_code": decision.Code,
+			}).Log(skipLevel, decision.Reason)
+			return nil
+		}
+	}
+
+	// The thresholds of the day are decided on in place of the defaults
+	now := time.Now()
+	query, overridden := ApplyWeekdayOverride(config, now)
+	if overridden {
+		logger.WithFields(log.Fields{
+			"op":                    "Run",
+			"weekday":               now.Weekday().String(),
+			"startThreshold":        query.StartThreshold,
+			"pastPrecipThreshold":   query.PastPrecipThreshold,
+			"futurePrecipThreshold": query.FuturePrecipThreshold,
+		}).Debug("applied weekday override")
+	}
+	pastThreshold, futureThreshold := query.startWindowThresholds()
+	if cliInputs.Action == "stop" {
+		futureThreshold = query.FuturePrecipThreshold
+	}
+
+	if cliInputs.Action == "start" && config.Query.SkipLookback {
+		logger.WithFields(log.Fields{
+			"op": "Run",
+		}).Debug("skipped lookback query")
+	} else if cliInputs.Action == "start" {
+		// Query past precipitation
+		pastPrecip, err = source.Lookback(context.Background(), pastThreshold)
+		if err == nil {
+			pastPrecip, err = NormalizePrecip(config.Query, "lookback", pastPrecip)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query lookback data, %w", err)
+		}
+	}
+
+	// Query future data
+	var noFutureData bool
+	futurePrecip, err = source.Lookforward(context.Background(), futureThreshold)
+	if err == nil {
+		futurePrecip, err = NormalizePrecip(config.Query, "lookforward", futurePrecip)
+	}
+	if errors.Is(err, ErrNoData) && cliInputs.Action == "stop" && config.Query.StopNoDataPolicy != "" &&
+		config.Query.StopNoDataPolicy != StopNoDataError {
+		logger.WithFields(log.Fields{
+			"op":     "Run",
+			"policy": config.Query.StopNoDataPolicy,
+		}).Warn("no lookforward data found, applying stop no-data policy")
+		noFutureData = true
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query lookforward data, %w", err)
+	}
+
+	if config.Query.SmoothingFactor > 0 {
+		pastQueried := cliInputs.Action == "start" && !config.Query.SkipLookback
+		rawPast, rawFuture := pastPrecip, futurePrecip
+		pastPrecip, futurePrecip, err = SmoothPrecip(config, pastQueried, !noFutureData, pastPrecip, futurePrecip)
+		if err != nil {
+			return fmt.Errorf("failed to smooth precipitation, %s", err)
+		}
+		logger.WithFields(log.Fields{
+			"op":                   "Run",
+			"pastPrecip":           rawPast,
+			"futurePrecip":         rawFuture,
+			"smoothedPastPrecip":   pastPrecip,
+			"smoothedFuturePrecip": futurePrecip,
+		}).Debug("smoothed precipitation")
+	}
+	logger = logger.WithFields(log.Fields{
+		"pastPrecip":   pastPrecip,
+		"futurePrecip": futurePrecip,
+	})
+
+	// Conditionally launch robot vacuum
+	if cliInputs.Action == "start" {
+		decision = DecideStart(query, pastPrecip, futurePrecip)
+		var rule *Rule
+		if len(config.Rules) > 0 {
+			decision, rule = DecideRules(config.Rules, pastPrecip, futurePrecip)
+		}
+		if config.Observed.Field != "" {
+			observed, err := source.(*InfluxSource).ObservedMax(context.Background())
+			if err == nil {
+				observed, err = NormalizePrecip(config.Query, "observed", observed)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to query observed precipitation, %w", err)
+			}
+			if Disagree(query, pastPrecip, observed) {
+				logger.WithFields(log.Fields{
+					"op":        "Run",
+					"observed":  observed,
+					"forecast":  pastPrecip,
+					"threshold": query.pastThreshold(),
+				}).Warn("observed precipitation and forecast disagree")
+			}
+			decision = ApplyObserved(query, decision, pastPrecip, observed)
+		}
+		if decision.Act && config.Query.MinDrySince != "" {
+			minutes, err := source.(RainRecencySource).MinutesSinceRain(context.Background(), query.pastThreshold())
+			if errors.Is(err, ErrNoData) {
+				logger.WithFields(log.Fields{
+					"op":          "Run",
+					"minDrySince": config.Query.MinDrySince,
+				}).Debug("no precipitation within minDrySince")
+			} else if err != nil {
+				return fmt.Errorf("failed to query time since last precipitation, %w", err)
+			} else {
+				decision = ApplyRainRecency(query, decision, minutes)
+			}
+		}
+		if decision.Act && config.Query.DryDaysRequired > 0 {
+			daily, err := source.(*InfluxSource).DailyMax(context.Background())
+			if err != nil {
+				return fmt.Errorf("failed to query daily precipitation, %w", err)
+			}
+			decision = ApplyDryDays(query, decision, daily)
+			logger.WithFields(log.Fields{
+				"op":    "Run",
+				"daily": daily,
+			}).Debug("checked dry days")
+		}
+		if decision.Act && config.Confidence.Field != "" {
+			confidence, err := source.(*InfluxSource).ForecastMin(context.Background(), config.Confidence.Connection,
+				config.Confidence.Measurement, config.Confidence.Field)
+			if err != nil {
+				return fmt.Errorf("failed to query forecast confidence, %w", err)
+			}
+			decision = ApplyConfidence(config.Confidence, decision, confidence)
+			logger.WithFields(log.Fields{
+				"op":         "Run",
+				"confidence": confidence,
+				"minimum":    config.Confidence.Minimum,
+			}).Debug("checked forecast confidence")
+		}
+		if decision.Act && config.Probability.Maximum != nil {
+			probability, err := source.(ProbabilitySource).ProbabilityMax(context.Background())
+			if err != nil {
+				return fmt.Errorf("failed to query probability of precipitation, %w", err)
+			}
+			decision = ApplyProbability(config.Probability, decision, probability)
+			logger.WithFields(log.Fields{
+				"op":          "Run",
+				"probability": probability,
+				"maximum":     *config.Probability.Maximum,
+			}).Debug("checked probability of precipitation")
+		}
+		if decision.Act && config.Dew.TemperatureField != "" {
+			spread, err := source.(*InfluxSource).DewPointSpread(context.Background())
+			if err != nil {
+				return fmt.Errorf("failed to query dew point spread, %w", err)
+			}
+			decision = ApplyDew(config.Dew, decision, spread)
+			logger.WithFields(log.Fields{
+				"op":     "Run",
+				"spread": spread,
+				"margin": config.Dew.Margin,
+			}).Debug("checked dew point spread")
+		}
+		if decision.Act && config.SoilMoisture.Field != "" {
+			maxAge := config.SoilMoisture.MaxAge
+			if maxAge <= 0 {
+				maxAge = defaultSoilMoistureMaxAge
+			}
+			value, err := source.(*InfluxSource).LatestValue(context.Background(), config.SoilMoisture.Connection,
+				config.SoilMoisture.Measurement, config.SoilMoisture.Field, maxAge)
+			if err != nil {
+				return fmt.Errorf("failed to query soil moisture, %w", err)
+			}
+			moisture, ok := toFloat(value)
+			if !ok {
+				return fmt.Errorf("soil moisture value %v is not numeric", value)
+			}
+			decision = ApplySoilMoisture(config.SoilMoisture, decision, moisture)
+			logger.WithFields(log.Fields{
+				"op":       "Run",
+				"moisture": moisture,
+				"maximum":  config.SoilMoisture.Maximum,
+			}).Debug("checked soil moisture")
+		}
+		if decision.Act && len(config.Query.Conditions) > 0 {
+			values, err := source.(*InfluxSource).ConditionValues(context.Background())
+			if err != nil {
+				return fmt.Errorf("failed to query conditions, %w", err)
+			}
+			decision = ApplyConditions(query, decision, values)
+			logger.WithFields(log.Fields{
+				"op":     "Run",
+				"values": values,
+			}).Debug("checked conditions")
+		}
+		if decision.Act && config.Vacuum.StatusField != "" {
+			maxAge := config.Vacuum.StatusMaxAge
+			if maxAge <= 0 {
+				maxAge = defaultStatusMaxAge
+			}
+			status, err := source.(*InfluxSource).LatestValue(context.Background(), config.Vacuum.StatusConnection,
+				config.Vacuum.StatusMeasurement, config.Vacuum.StatusField, maxAge)
+			if err != nil {
+				return fmt.Errorf("failed to query vacuum status, %w", err)
+			}
+			decision = ApplyVacuumStatus(config.Vacuum, decision, fmt.Sprint(status))
+		}
+		decision = ApplyConflict(config.Schedule.ConflictPolicy, cliInputs.Action, config.conflicted[config.device], decision)
+		if decision.Act && config.decideOnly {
+			return nil
+		}
+		if decision.Act && config.DryRun {
+			LogDryRun(logger, cliInputs.Action, decision)
+		} else if decision.Act {
+			env := HookEnvironment(config.device, cliInputs.Action, decision, pastPrecip, futurePrecip)
+			if err := RunHook(config.Vacuum.PreStartCommand, env); err != nil {
+				return fmt.Errorf("pre-start command failed (%w), not starting vacuum, %s", ErrHook, err)
+			}
+			data := NewWebhookData(config, cliInputs.Action, decision, pastPrecip, futurePrecip)
+			response, err := TriggerRuleWebhook(config, rule, data)
+			if err != nil {
+				if response != "" {
+					logger.WithFields(log.Fields{
+						"op":       "Run",
+						"response": truncate(response, maxResponseLogLength),
+					}).Error("start webhook returned an error")
+				}
+				return fmt.Errorf("failed to start robot vacuum (%w), %s", ErrWebhook, err)
+			}
+			fired = true
+			fields := log.Fields{
+				"op":                  "Run",
+				"lookbackDuration":    config.Query.LookbackDuration,
+				"lookforwardDuration": config.Query.LookforwardDuration,
+				"reason_code":         decision.Code,
+				"response":            truncate(response, maxResponseLogLength),
+			}
+			if config.Query.ReportDryWindow {
+				// Informational only, a failure must not fail the started run
+				dryWindow, err := source.(*InfluxSource).ExpectedDryWindow(context.Background(), query.futureThreshold())
+				if err != nil {
+					logger.WithFields(log.Fields{
+						"op":    "Run",
+						"error": err,
+					}).Warn("failed to determine expected dry window")
+				} else {
+					fields["expectedDryWindow"] = dryWindow.Truncate(time.Minute).String()
+				}
+			}
+			logger.WithFields(fields).Info(decision.Reason)
+			// The start has been fired, so another attempt must not repeat it
+			if err := RunHook(config.Vacuum.PostStartCommand, env); err != nil {
+				return fmt.Errorf("post-start command failed (%w, %w), %s", ErrHook, ErrNotRetryable, err)
+			}
+			if config.Vacuum.VerifyField != "" {
+				if err := VerifyStart(ctx, config, source.(*InfluxSource), rule, data, logger); err != nil {
+					return err
+				}
+			}
+		} else {
+			logger.WithFields(log.Fields{
+				"op":                  "Run",
+				"lookbackDuration":    config.Query.LookbackDuration,
+				"lookforwardDuration": config.Query.LookforwardDuration,
+				"reason_code":         decision.Code,
+			}).Log(skipLevel, decision.Reason)
+		}
+	}
+
+	// Conditionally stop robot vacuum
+	if cliInputs.Action == "stop" {
+		decision = DecideStop(config.Vacuum, query, futurePrecip)
+		if noFutureData {
+			decision, _ = DecideStopNoData(config.Vacuum, config.Query.StopNoDataPolicy)
+		} else {
+			if decision.Act && config.Vacuum.StopLeadTime > 0 {
+				firstWet, err := source.(*InfluxSource).FirstWet(context.Background(), query.FuturePrecipThreshold)
+				if err != nil {
+					return fmt.Errorf("failed to query time of first precipitation, %w", err)
+				}
+				decision = ApplyStopLeadTime(config.Vacuum, decision, time.Until(firstWet))
+			}
+			if decision.Act && config.Vacuum.StopGracePeriod > 0 && !config.decideOnly {
+				// Let light, brief rain pass before stopping
+				logger.WithFields(log.Fields{
+					"op":           "Run",
+					"futurePrecip": futurePrecip,
+					"gracePeriod":  config.Vacuum.StopGracePeriod,
+				}).Info("precipitation found in forecast, re-checking after grace period")
+				timer := time.NewTimer(config.Vacuum.StopGracePeriod)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return fmt.Errorf("interrupted during the stop grace period, %w", ctx.Err())
+				case <-timer.C:
+				}
+				futurePrecip, err = source.Lookforward(context.Background(), futureThreshold)
+				if err == nil {
+					futurePrecip, err = NormalizePrecip(config.Query, "lookforward", futurePrecip)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to re-check lookforward data, %w", err)
+				}
+				logger = logger.WithField("futurePrecip", futurePrecip)
+				decision = DecideStop(config.Vacuum, query, futurePrecip)
+			}
+		}
+		decision = ApplyConflict(config.Schedule.ConflictPolicy, cliInputs.Action, config.conflicted[config.device], decision)
+		if decision.Act && config.decideOnly {
+			return nil
+		}
+		if decision.Act && config.DryRun {
+			LogDryRun(logger, cliInputs.Action, decision)
+		} else if decision.Act {
+			env := HookEnvironment(config.device, cliInputs.Action, decision, pastPrecip, futurePrecip)
+			if err := RunHook(config.Vacuum.PreStopCommand, env); err != nil {
+				return fmt.Errorf("pre-stop command failed (%w), not stopping vacuum, %s", ErrHook, err)
+			}
+			response, err := TriggerStopWebhook(config, NewWebhookData(config, cliInputs.Action, decision, pastPrecip, futurePrecip))
+			if err != nil {
+				if response != "" {
+					logger.WithFields(log.Fields{
+						"op":       "Run",
+						"response": truncate(response, maxResponseLogLength),
+					}).Error("stop webhook returned an error")
+				}
+				return fmt.Errorf("failed to stop robot vacuum (%w), %s", ErrWebhook, err)
+			}
+			fired = true
+			logger.WithFields(log.Fields{
+				"op":                  "Run",
+				"lookforwardDuration": config.Query.LookforwardDuration,
+				"reason_code":         decision.Code,
+				"response":            truncate(response, maxResponseLogLength),
+			}).Info(decision.Reason)
+			if err := RunHook(config.Vacuum.PostStopCommand, env); err != nil {
+				return fmt.Errorf("post-stop command failed (%w, %w), %s", ErrHook, ErrNotRetryable, err)
+			}
+		} else {
+			logger.WithFields(log.Fields{
+				"op":                  "Run",
+				"lookforwardDuration": config.Query.LookforwardDuration,
+				"reason_code":         decision.Code,
+			}).Log(skipLevel, decision.Reason)
+		}
+	}
+
+	return nil
+}
+
+// ForceAction fires the webhook for the action without querying the source,
+// running hooks or applying any guard.
+func ForceAction(config *Configuration, action string, decision Decision, logger *log.Entry) error {
+	if config.DryRun {
+		LogDryRun(logger, action, decision)
+		return nil
+	}
+	var response string
+	var err error
+	data := NewWebhookData(config, action, decision, 0, 0)
+	if action == "stop" {
+		response, err = TriggerStopWebhook(config, data)
+	} else {
+		response, err = TriggerStartWebhook(config, data)
+	}
+	if err != nil {
+		if response != "" {
+			logger.WithFields(log.Fields{
+				"op":       "ForceAction",
+				"response": truncate(response, maxResponseLogLength),
+			}).Error(action + " webhook returned an error")
+		}
+		return fmt.Errorf("failed to force %s of robot vacuum (%w), %s", action, ErrWebhook, err)
+	}
+	logger.WithFields(log.Fields{
+		"op":          "ForceAction",
+		"reason_code": decision.Code,
+		"response":    truncate(response, maxResponseLogLength),
+	}).Warn(decision.Reason)
+	return nil
+}
+
+// LogDryRun logs the action a dry run would have taken in place of firing the
+// webhook and hooks.
+func LogDryRun(logger *log.Entry, action string, decision Decision) {
+	logger.WithFields(log.Fields{
+		"op":          "Run",
+		"action":      action,
+		"reason_code": decision.Code,
+		"dry_run":     true,
+	}).Info("dry run, would have acted: " + decision.Reason)
+}
+
+// LogSummary writes the single structured log entry closing every run. It is
+// demoted to debug in quiet mode unless a webhook fired or the run failed.
+func LogSummary(logger *log.Entry, quiet bool, summary RunSummary) {
+	fields := log.Fields{
+		"op":           "Run",
+		"action":       summary.Action,
+		"act":          summary.Act,
+		"reason_code":  summary.ReasonCode,
+		"pastPrecip":   summary.PastPrecip,
+		"futurePrecip": summary.FuturePrecip,
+		"webhookFired": summary.WebhookFired,
+		"duration":     summary.Duration,
+	}
+	if summary.DryRun {
+		fields["dry_run"] = true
+	}
+	level := log.InfoLevel
+	if summary.Error != "" {
+		fields["error"] = summary.Error
+		level = log.ErrorLevel
+	} else if quiet && !summary.WebhookFired {
+		level = log.DebugLevel
+	}
+	logger.WithFields(fields).Log(level, "run summary")
+}
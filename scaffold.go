@@ -0,0 +1,27 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+)
+
+// exampleConfig is the annotated example configuration shipped with the
+// source, documenting every supported field
+//
+//go:embed config.yaml.example
+var exampleConfig []byte
+
+// WriteExampleConfig writes the annotated example configuration to path,
+// refusing to overwrite an existing file.
+func WriteExampleConfig(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating config file, %s", err)
+	}
+	if _, err := file.Write(exampleConfig); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing config file, %s", err)
+	}
+	return file.Close()
+}
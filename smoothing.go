@@ -0,0 +1,36 @@
+package main
+
+// SmoothPrecip folds the queried precipitation into the exponentially
+// weighted moving averages kept in the state file and returns the averages in
+// their place. Only the windows queried by the run are updated; the other
+// value is returned unchanged.
+func SmoothPrecip(config *Configuration, pastQueried bool, futureQueried bool, pastPrecip float64, futurePrecip float64) (float64, float64, error) {
+	state, err := LoadState(config.StateFile)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	alpha := config.Query.SmoothingFactor
+	if pastQueried {
+		pastPrecip = ewma(state.PastPrecipAverage, pastPrecip, alpha)
+		state.PastPrecipAverage = &pastPrecip
+	}
+	if futureQueried {
+		futurePrecip = ewma(state.FuturePrecipAverage, futurePrecip, alpha)
+		state.FuturePrecipAverage = &futurePrecip
+	}
+
+	if err := state.Save(config.StateFile); err != nil {
+		return 0, 0, err
+	}
+	return pastPrecip, futurePrecip, nil
+}
+
+// ewma updates an exponentially weighted moving average with a new value. The
+// first value seeds the average.
+func ewma(average *float64, value float64, alpha float64) float64 {
+	if average == nil {
+		return value
+	}
+	return alpha*value + (1-alpha)*(*average)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Supported precipitation sources
+const (
+	SourceInfluxDB = "influxdb"
+	SourceCSV      = "csv"
+	SourceAPI      = "api"
+	SourceForecast = "forecast"
+)
+
+// Policies for handling NaN or infinite query results
+const (
+	NonFiniteError = "error"
+	NonFiniteWet   = "treat-as-wet"
+	NonFiniteDry   = "treat-as-dry"
+)
+
+// Policies for query results unexpectedly spanning multiple fields
+const (
+	MultipleFieldsError = "error"
+	MultipleFieldsMax   = "max"
+)
+
+// ErrNoData is returned by sources when a window holds no data at all
+var ErrNoData = errors.New("no data returned")
+
+// ErrNotRetryable marks failures another attempt cannot fix, such as a query
+// rejected by InfluxDB as invalid
+var ErrNotRetryable = errors.New("not retryable")
+
+// ErrWebhook marks failures to command the vacuum, as opposed to failures to
+// query or decide
+var ErrWebhook = errors.New("webhook failed")
+
+// ErrHook marks failures of the commands run before and after the vacuum is
+// commanded
+var ErrHook = errors.New("hook failed")
+
+// Source provides the precipitation values the decision logic is based on.
+// The windows are given the threshold they are decided on, which sources
+// judging series against thresholds of their own report at least up to.
+type Source interface {
+	// Lookback returns the maximum precipitation over the lookback window
+	Lookback(ctx context.Context, threshold float64) (float64, error)
+	// Lookforward returns the maximum precipitation over the lookforward window
+	Lookforward(ctx context.Context, threshold float64) (float64, error)
+	// Close releases any resources held by the source
+	Close()
+}
+
+// ProbabilitySource is implemented by the sources able to report the
+// probability of precipitation
+type ProbabilitySource interface {
+	// ProbabilityMax returns the highest probability of precipitation, in
+	// percent, over the lookforward window
+	ProbabilityMax(ctx context.Context) (float64, error)
+}
+
+// RainRecencySource is implemented by the sources able to tell when
+// precipitation last fell
+type RainRecencySource interface {
+	// MinutesSinceRain returns how many minutes ago the last precipitation
+	// above the threshold fell, looking back Query.MinDrySince; ErrNoData
+	// means it has been dry for at least that long
+	MinutesSinceRain(ctx context.Context, threshold float64) (float64, error)
+}
+
+// RefreshableSource is implemented by the sources resolving part of their
+// setup from the stored data, which a reused source must redo before each
+// evaluation
+type RefreshableSource interface {
+	// Refresh resolves the setup again from the data currently stored
+	Refresh(ctx context.Context) error
+}
+
+// NewSource builds the precipitation source selected in the configuration.
+func NewSource(config *Configuration) (Source, error) {
+	switch config.Source {
+	case SourceCSV:
+		return NewCSVSource(config), nil
+	case SourceAPI:
+		return NewAPISource(config), nil
+	case SourceForecast:
+		return NewForecastSource(config)
+	}
+	if config.InfluxDB.QueryLanguage == QueryLanguageInfluxQL {
+		return NewInfluxQLSource(config), nil
+	}
+	return NewInfluxSource(config)
+}
+
+// NormalizePrecip prepares a queried precipitation value for the decision:
+// non-finite values are handled according to Query.NonFinitePolicy, while
+// negative values from calibration drift and values below the sensor
+// resolution, Query.MinSignificant, are clamped to zero.
+func NormalizePrecip(query Query, window string, value float64) (float64, error) {
+	value, err := HandleNonFinite(query, window, value)
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 || value < query.MinSignificant {
+		return 0, nil
+	}
+	return value, nil
+}
+
+// HandleNonFinite applies Query.NonFinitePolicy to a queried precipitation
+// value. Comparisons against NaN are always false, so a NaN would otherwise
+// silently count as dry for starting and stopping alike.
+func HandleNonFinite(query Query, window string, value float64) (float64, error) {
+	if !math.IsNaN(value) && !math.IsInf(value, 0) {
+		return value, nil
+	}
+
+	policy := query.NonFinitePolicy
+	if policy == "" {
+		policy = NonFiniteError
+	}
+	log.WithFields(log.Fields{
+		"op":     "HandleNonFinite",
+		"window": window,
+		"value":  value,
+		"policy": policy,
+	}).Warn("received non-finite precipitation value")
+
+	switch policy {
+	case NonFiniteWet:
+		return math.MaxFloat64, nil
+	case NonFiniteDry:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("received non-finite %s precipitation value %v", window, value)
+}
+
+// SignificantPrecip combines the accumulation and wet interval count of a
+// window into a single precipitation value. Precipitation only counts when the
+// total exceeds WetAmountThreshold and it fell for longer than
+// WetDurationThreshold; otherwise the window is treated as dry.
+func SignificantPrecip(query Query, total float64, wetIntervals int64) (float64, error) {
+	interval, err := ParseFluxDuration(query.WetInterval)
+	if err != nil {
+		return 0, err
+	}
+	minDuration, err := ParseFluxDuration(query.WetDurationThreshold)
+	if err != nil {
+		return 0, err
+	}
+
+	wetDuration := time.Duration(wetIntervals) * interval
+	if total > query.WetAmountThreshold && wetDuration > minDuration {
+		return total, nil
+	}
+	return 0, nil
+}
+
+// fluxDurationUnits maps Flux duration units to their length
+var fluxDurationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// ParseFluxDuration parses a Flux duration literal such as 1d12h so that the
+// same configuration values can be evaluated outside of InfluxDB. Calendar
+// units (mo, y) are not supported.
+func ParseFluxDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	var total time.Duration
+	rest := value
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %s", value)
+		}
+		magnitude, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s, %s", value, err)
+		}
+		rest = rest[i:]
+
+		j := 0
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') {
+			j++
+		}
+		unit, ok := fluxDurationUnits[rest[:j]]
+		if !ok {
+			return 0, fmt.Errorf("invalid duration %s, unsupported unit %q", value, rest[:j])
+		}
+		total += time.Duration(magnitude) * unit
+		rest = rest[j:]
+	}
+	return total, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// State is persisted between runs in the state file
+type State struct {
+	NextStartWebhook    int               `json:"next_start_webhook"`
+	PastPrecipAverage   *float64          `json:"past_precip_average,omitempty"`
+	FuturePrecipAverage *float64          `json:"future_precip_average,omitempty"`
+	ConsecutiveFailures int               `json:"consecutive_failures"`
+	FailsafeStopped     bool              `json:"failsafe_stopped"`
+	LastAct             map[string]bool   `json:"last_act,omitempty"`
+	NWSGridpoints       map[string]string `json:"nws_gridpoints,omitempty"`
+}
+
+// LoadState reads the state file. A missing file yields an empty state.
+func LoadState(path string) (*State, error) {
+	var state State
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file, %s", err)
+	}
+	if err := json.Unmarshal(contents, &state); err != nil {
+		return nil, fmt.Errorf("unable to decode state file, %s", err)
+	}
+	return &state, nil
+}
+
+// Save writes the state file, replacing it atomically so a crash cannot
+// leave it truncated.
+func (s *State) Save(path string) error {
+	contents, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("unable to encode state, %s", err)
+	}
+	if err := writeFileAtomic(path, contents); err != nil {
+		return fmt.Errorf("error writing state file, %s", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file through a temporary file in the same
+// directory renamed over it, so readers never see a partial file.
+func writeFileAtomic(path string, contents []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tuya holds the parameters for commanding the vacuum, such as a Eufy
+// RoboVac, through the Tuya IoT platform cloud API
+type Tuya struct {
+	Region       string
+	URL          string
+	AccessID     string
+	AccessSecret string
+	DeviceID     string
+	Start        []TuyaCommand
+	Stop         []TuyaCommand
+	Return       []TuyaCommand
+}
+
+// TuyaCommand is a single device instruction, e.g. power_go set to true
+type TuyaCommand struct {
+	Code  string      `json:"code"`
+	Value interface{} `json:"value"`
+}
+
+// Commands sent to the Tuya device
+const (
+	tuyaStart  = "start"
+	tuyaStop   = "stop"
+	tuyaReturn = "return"
+)
+
+// tuyaRegions maps the data center regions of the Tuya IoT platform to their
+// API endpoint
+var tuyaRegions = map[string]string{
+	"cn":      "https://openapi.tuyacn.com",
+	"us":      "https://openapi.tuyaus.com",
+	"us-east": "https://openapi-ueaz.tuyaus.com",
+	"eu":      "https://openapi.tuyaeu.com",
+	"eu-west": "https://openapi-weaz.tuyaeu.com",
+	"in":      "https://openapi.tuyain.com",
+}
+
+// tuyaDefaultCommands are the instructions of the standard robot vacuum
+// instruction set, which Eufy RoboVacs support
+var tuyaDefaultCommands = map[string][]TuyaCommand{
+	tuyaStart:  {{Code: "power_go", Value: true}},
+	tuyaStop:   {{Code: "pause", Value: true}},
+	tuyaReturn: {{Code: "switch_charge", Value: true}},
+}
+
+// tuyaResponse is the envelope of every Tuya API response
+type tuyaResponse struct {
+	Success bool            `json:"success"`
+	Code    int             `json:"code"`
+	Msg     string          `json:"msg"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// commands returns the configured instructions for the command, or the
+// defaults.
+func (t Tuya) commands(command string) []TuyaCommand {
+	var commands []TuyaCommand
+	switch command {
+	case tuyaStart:
+		commands = t.Start
+	case tuyaStop:
+		commands = t.Stop
+	case tuyaReturn:
+		commands = t.Return
+	}
+	if len(commands) == 0 {
+		return tuyaDefaultCommands[command]
+	}
+	return commands
+}
+
+// endpoint returns the base URL of the API.
+func (t Tuya) endpoint() string {
+	if t.URL != "" {
+		return strings.TrimSuffix(t.URL, "/")
+	}
+	return tuyaRegions[strings.ToLower(t.Region)]
+}
+
+// CallTuya sends the instructions for the command to the configured device,
+// once per vacuum ID when the device ID is a template like the webhook URLs.
+// A single access token is requested for the run. Every vacuum is attempted
+// even if an earlier one fails.
+func CallTuya(config *Configuration, command string) (string, error) {
+	settings := config.Vacuum.Tuya
+	deviceIDs, err := WebhookURLs(config, settings.DeviceID)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(map[string][]TuyaCommand{"commands": settings.commands(command)})
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: config.Vacuum.Timeout}
+	token, err := tuyaToken(client, settings)
+	if err != nil {
+		return "", err
+	}
+
+	var responses []string
+	var failures []string
+	for _, deviceID := range deviceIDs {
+		path := "/v1.0/devices/" + url.PathEscape(deviceID) + "/commands"
+		response, err := tuyaRequest(client, settings, token, http.MethodPost, path, payload)
+		if len(deviceIDs) > 1 {
+			response = deviceID + ": " + response
+		}
+		responses = append(responses, response)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", deviceID, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return strings.Join(responses, "\n"), fmt.Errorf("tuya command failed for %s", strings.Join(failures, "; "))
+	}
+	return strings.Join(responses, "\n"), nil
+}
+
+// tuyaToken requests an access token for the cloud project.
+func tuyaToken(client *http.Client, settings Tuya) (string, error) {
+	response, err := tuyaRequest(client, settings, "", http.MethodGet, "/v1.0/token?grant_type=1", nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to get tuya access token, %s", err)
+	}
+	var envelope tuyaResponse
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(response), &envelope); err != nil {
+		return "", fmt.Errorf("unable to decode tuya token response, %s", err)
+	}
+	if err := json.Unmarshal(envelope.Result, &result); err != nil || result.AccessToken == "" {
+		return "", fmt.Errorf("tuya token response holds no access token")
+	}
+	return result.AccessToken, nil
+}
+
+// tuyaRequest sends a signed request and returns the response body. The
+// token is empty when requesting one. Failures reported in the response
+// envelope are returned as errors.
+func tuyaRequest(client *http.Client, settings Tuya, token string, method string, path string, payload []byte) (string, error) {
+	var requestBody io.Reader
+	if payload != nil {
+		requestBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, settings.endpoint()+path, requestBody)
+	if err != nil {
+		return "", fmt.Errorf("unable to build tuya request, %s", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	req.Header.Set("client_id", settings.AccessID)
+	req.Header.Set("t", timestamp)
+	req.Header.Set("sign_method", "HMAC-SHA256")
+	req.Header.Set("sign", tuyaSign(settings, token, timestamp, method, path, payload))
+	if token != "" {
+		req.Header.Set("access_token", token)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading tuya response, %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return string(body), fmt.Errorf("tuya returned status %d", resp.StatusCode)
+	}
+
+	var envelope tuyaResponse
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return string(body), fmt.Errorf("unable to decode tuya response, %s", err)
+	}
+	if !envelope.Success {
+		return string(body), fmt.Errorf("tuya returned error %d, %s", envelope.Code, envelope.Msg)
+	}
+	return string(body), nil
+}
+
+// tuyaSign computes the request signature: an HMAC-SHA256, keyed with the
+// access secret, of the access ID, token, timestamp and a canonical form of
+// the request made of the method, the SHA256 of the body and the path with
+// its query.
+func tuyaSign(settings Tuya, token string, timestamp string, method string, path string, payload []byte) string {
+	bodyHash := sha256.Sum256(payload)
+	canonical := method + "\n" + hex.EncodeToString(bodyHash[:]) + "\n\n" + path
+	mac := hmac.New(sha256.New, []byte(settings.AccessSecret))
+	mac.Write([]byte(settings.AccessID + token + timestamp + canonical))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// validateTuya checks the cloud API settings when the vacuum is commanded
+// through Tuya.
+func validateTuya(c *Configuration) error {
+	settings := c.Vacuum.Tuya
+	if settings.AccessID == "" || settings.AccessSecret == "" || settings.DeviceID == "" {
+		return fmt.Errorf("tuya.accessId, tuya.accessSecret and tuya.deviceId must be set when the vacuum protocol is tuya")
+	}
+	if settings.URL == "" {
+		if _, ok := tuyaRegions[strings.ToLower(settings.Region)]; !ok {
+			return fmt.Errorf("unknown tuya region %s", settings.Region)
+		}
+	}
+	for _, command := range [][]TuyaCommand{settings.Start, settings.Stop, settings.Return} {
+		for _, instruction := range command {
+			if instruction.Code == "" {
+				return fmt.Errorf("tuya command code must be set")
+			}
+		}
+	}
+	_, err := WebhookURLs(c, settings.DeviceID)
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// VerifyStart waits Vacuum.VerifyAfter and then checks the state the vacuum
+// reports in InfluxDB against the expected value. On a mismatch the start
+// webhook, or that of the matched rule, is optionally fired once more and the
+// state checked again. The start has already been fired, so every error is
+// marked as not retryable lest another attempt fire it again. The waits end
+// early once ctx is done.
+func VerifyStart(ctx context.Context, config *Configuration, source *InfluxSource, rule *Rule, data WebhookData, logger *log.Entry) error {
+	attempts := 1
+	if config.Vacuum.VerifyRetry {
+		attempts = 2
+	}
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		timer := time.NewTimer(config.Vacuum.VerifyAfter)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("interrupted while verifying the start (%w), %w", ErrNotRetryable, ctx.Err())
+		case <-timer.C:
+		}
+
+		state, err := source.LatestValue(ctx, config.Vacuum.VerifyConnection, config.Vacuum.VerifyMeasurement,
+			config.Vacuum.VerifyField, config.Vacuum.VerifyAfter)
+		if err != nil {
+			return fmt.Errorf("failed to query vacuum state (%w), %w", ErrNotRetryable, err)
+		}
+
+		if fmt.Sprint(state) == config.Vacuum.VerifyExpected {
+			logger.WithFields(log.Fields{
+				"op":    "VerifyStart",
+				"state": state,
+			}).Info("verified robot vacuum reports running")
+			return nil
+		}
+
+		logger.WithFields(log.Fields{
+			"op":       "VerifyStart",
+			"state":    state,
+			"expected": config.Vacuum.VerifyExpected,
+		}).Warn("robot vacuum does not report running")
+
+		if attempt < attempts {
+			response, err := TriggerRuleWebhook(config, rule, data)
+			if err != nil {
+				return fmt.Errorf("failed to retry starting robot vacuum (%w, %w), %s", ErrWebhook, ErrNotRetryable, err)
+			}
+			logger.WithFields(log.Fields{
+				"op":       "VerifyStart",
+				"response": truncate(response, maxResponseLogLength),
+			}).Info("retried starting robot vacuum")
+		}
+	}
+	return nil
+}
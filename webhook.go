@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Protocols for commanding the vacuum
+const (
+	ProtocolHTTP          = "http"
+	ProtocolMQTT          = "mqtt"
+	ProtocolHomeAssistant = "homeassistant"
+	ProtocolTuya          = "tuya"
+)
+
+// usesWebhooks reports whether the vacuum is commanded with HTTP webhooks.
+func (v Vacuum) usesWebhooks() bool {
+	return v.Protocol == "" || v.Protocol == ProtocolHTTP
+}
+
+// hasStop reports whether a command stopping the vacuum is configured for
+// its protocol.
+func (v Vacuum) hasStop() bool {
+	switch v.Protocol {
+	case ProtocolMQTT:
+		return v.StopMessage().Topic != ""
+	case ProtocolHomeAssistant, ProtocolTuya:
+		return true
+	}
+	return v.StopWebhook().URL != ""
+}
+
+// maxResponseLogLength caps how much of a webhook response body is logged
+const maxResponseLogLength = 512
+
+// webhookTarget is the data available to webhook templates. URLs only see
+// the ID, bodies and headers also see the decision.
+type webhookTarget struct {
+	ID string
+	WebhookData
+}
+
+// WebhookData describes the decision a webhook is fired for, e.g.
+// {"past": {{.PastPrecip}}, "reason": "{{.ReasonCode}}"} in a body template
+type WebhookData struct {
+	Device              string
+	Action              string
+	ReasonCode          string
+	Reason              string
+	PastPrecip          float64
+	FuturePrecip        float64
+	LookbackDuration    string
+	LookforwardDuration string
+	Timestamp           time.Time
+}
+
+// NewWebhookData describes the decision for webhook templates.
+func NewWebhookData(config *Configuration, action string, decision Decision, pastPrecip float64, futurePrecip float64) WebhookData {
+	return WebhookData{
+		Device:              config.device,
+		Action:              action,
+		ReasonCode:          decision.Code,
+		Reason:              decision.Reason,
+		PastPrecip:          pastPrecip,
+		FuturePrecip:        futurePrecip,
+		LookbackDuration:    config.Query.LookbackDuration,
+		LookforwardDuration: config.Query.LookforwardDuration,
+		Timestamp:           time.Now(),
+	}
+}
+
+// WebhookRequest describes the HTTP request sent for an action. The method
+// defaults to GET. The body and header values are templates rendered with
+// WebhookData.
+type WebhookRequest struct {
+	URL     string
+	Method  string
+	Body    string
+	Headers map[string]string
+}
+
+// withURL falls back to the given top-level webhook URL when the request does
+// not set its own.
+func (r WebhookRequest) withURL(url string) WebhookRequest {
+	if r.URL == "" {
+		r.URL = url
+	}
+	return r
+}
+
+// StartWebhook returns the request starting the vacuum.
+func (v Vacuum) StartWebhook() WebhookRequest {
+	return v.Start.withURL(v.WebhookStart)
+}
+
+// StopWebhook returns the request stopping the vacuum, or sending it back to
+// base when ReturnToBase is set.
+func (v Vacuum) StopWebhook() WebhookRequest {
+	if v.ReturnToBase {
+		return v.Return.withURL(v.WebhookReturn)
+	}
+	return v.Stop.withURL(v.WebhookStop)
+}
+
+// TriggerRuleWebhook sends the webhook of the matched start rule, or the
+// regular start command when no rules are configured or the rule has no
+// webhook of its own.
+func TriggerRuleWebhook(config *Configuration, rule *Rule, data WebhookData) (string, error) {
+	if rule == nil || rule.Webhook.URL == "" {
+		return TriggerStartWebhook(config, data)
+	}
+	return TriggerWebhook(config, rule.Webhook, data)
+}
+
+// TriggerStopWebhook stops the vacuum, or sends it back to base, over the
+// configured protocol.
+func TriggerStopWebhook(config *Configuration, data WebhookData) (string, error) {
+	switch config.Vacuum.Protocol {
+	case ProtocolMQTT:
+		return PublishMQTT(config, config.Vacuum.StopMessage(), data)
+	case ProtocolHomeAssistant:
+		if config.Vacuum.ReturnToBase {
+			return CallHomeAssistant(config, homeAssistantReturn)
+		}
+		return CallHomeAssistant(config, homeAssistantStop)
+	case ProtocolTuya:
+		if config.Vacuum.ReturnToBase {
+			return CallTuya(config, tuyaReturn)
+		}
+		return CallTuya(config, tuyaStop)
+	}
+	return TriggerWebhook(config, config.Vacuum.StopWebhook(), data)
+}
+
+// Strategies for picking the first of several start webhooks
+const (
+	WebhookSelectionRandom     = "random"
+	WebhookSelectionRoundRobin = "round-robin"
+)
+
+// TriggerStartWebhook sends the start webhook. When Vacuum.WebhookStarts
+// lists several mirrored endpoints one is picked per Vacuum.WebhookSelection
+// and the others are tried in turn if it fails. With the mqtt protocol the
+// start message is published instead, with homeassistant the start service
+// is called, and with tuya the start instructions are sent.
+func TriggerStartWebhook(config *Configuration, data WebhookData) (string, error) {
+	switch config.Vacuum.Protocol {
+	case ProtocolMQTT:
+		return PublishMQTT(config, config.Vacuum.MQTT.Start, data)
+	case ProtocolHomeAssistant:
+		return CallHomeAssistant(config, homeAssistantStart)
+	case ProtocolTuya:
+		return CallTuya(config, tuyaStart)
+	}
+	urls := config.Vacuum.WebhookStarts
+	if len(urls) == 0 {
+		return TriggerWebhook(config, config.Vacuum.StartWebhook(), data)
+	}
+
+	first, err := firstStartWebhook(config, len(urls))
+	if err != nil {
+		return "", err
+	}
+
+	var response string
+	for i := range urls {
+		webhook := config.Vacuum.Start
+		webhook.URL = urls[(first+i)%len(urls)]
+		response, err = TriggerWebhook(config, webhook, data)
+		if err == nil {
+			return response, nil
+		}
+		log.WithFields(log.Fields{
+			"op":    "TriggerStartWebhook",
+			"url":   webhook.URL,
+			"error": err,
+		}).Warn("start webhook failed, trying the next one")
+	}
+	return response, err
+}
+
+// firstStartWebhook picks the index of the start webhook to try first. The
+// round-robin position is kept in the state file.
+func firstStartWebhook(config *Configuration, count int) (int, error) {
+	if config.Vacuum.WebhookSelection != WebhookSelectionRoundRobin {
+		return rand.IntN(count), nil
+	}
+	state, err := LoadState(config.StateFile)
+	if err != nil {
+		return 0, err
+	}
+	first := state.NextStartWebhook % count
+	state.NextStartWebhook = (first + 1) % count
+	if err := state.Save(config.StateFile); err != nil {
+		return 0, err
+	}
+	return first, nil
+}
+
+// TriggerWebhook sends the given webhook request. When vacuum IDs are
+// configured the URL is a template rendered and sent once per ID, e.g.
+// http://hub/api/vacuum/{{.ID}}/start. The body and header values are
+// rendered with the ID and the decision data. Every vacuum is attempted even
+// if an earlier one fails; the responses are joined for logging.
+func TriggerWebhook(config *Configuration, webhook WebhookRequest, data WebhookData) (string, error) {
+	urls, err := WebhookURLs(config, webhook.URL)
+	if err != nil {
+		return "", err
+	}
+	bodies, err := WebhookBodies(config, webhook.Body, data)
+	if err != nil {
+		return "", err
+	}
+	headers := make(map[string][]string, len(webhook.Headers))
+	for key, value := range webhook.Headers {
+		if headers[key], err = WebhookBodies(config, value, data); err != nil {
+			return "", err
+		}
+	}
+
+	var responses []string
+	var failures []string
+	for i, url := range urls {
+		request := webhook
+		request.URL = url
+		request.Body = bodies[i]
+		request.Headers = make(map[string]string, len(headers))
+		for key, values := range headers {
+			request.Headers[key] = values[i]
+		}
+		response, err := CallWebhook(config, request)
+		if len(urls) > 1 {
+			response = url + ": " + response
+		}
+		responses = append(responses, response)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", url, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return strings.Join(responses, "\n"), fmt.Errorf("webhook failed for %s", strings.Join(failures, "; "))
+	}
+	return strings.Join(responses, "\n"), nil
+}
+
+// WebhookURLs expands a webhook URL template for each configured vacuum ID.
+// Without IDs the webhook is returned as is.
+func WebhookURLs(config *Configuration, webhook string) ([]string, error) {
+	if len(config.Vacuum.IDs) == 0 {
+		return []string{webhook}, nil
+	}
+	return renderWebhook(config.Vacuum.IDs, webhook, WebhookData{})
+}
+
+// WebhookBodies expands a webhook body or header template with the decision
+// data for each configured vacuum ID, or once without IDs.
+func WebhookBodies(config *Configuration, body string, data WebhookData) ([]string, error) {
+	ids := config.Vacuum.IDs
+	if len(ids) == 0 {
+		ids = []string{""}
+	}
+	return renderWebhook(ids, body, data)
+}
+
+// renderWebhook renders the template once per ID.
+func renderWebhook(ids []string, webhook string, data WebhookData) ([]string, error) {
+	tmpl, err := template.New("webhook").Option("missingkey=error").Parse(webhook)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template %s, %s", webhook, err)
+	}
+
+	rendered := make([]string, len(ids))
+	for i, id := range ids {
+		var text strings.Builder
+		if err := tmpl.Execute(&text, webhookTarget{ID: id, WebhookData: data}); err != nil {
+			return nil, fmt.Errorf("unable to render webhook template for %s, %s", id, err)
+		}
+		rendered[i] = text.String()
+	}
+	return rendered, nil
+}
+
+// CallWebhook sends the webhook request and returns the response body. The
+// response status must be one of Vacuum.SuccessStatusCodes, any 2xx by
+// default. When a response field is configured the body is parsed as JSON and
+// the field (a JSONPath such as $.result.status) is checked against the
+// expected success value.
+func CallWebhook(config *Configuration, webhook WebhookRequest) (string, error) {
+	method := webhook.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var requestBody io.Reader
+	if webhook.Body != "" {
+		requestBody = strings.NewReader(webhook.Body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), webhook.URL, requestBody)
+	if err != nil {
+		return "", fmt.Errorf("unable to build webhook request, %s", err)
+	}
+	for key, value := range webhook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: config.Vacuum.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading webhook response, %s", err)
+	}
+	if !webhookSucceeded(config.Vacuum, resp.StatusCode) {
+		return string(body), fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+
+	if config.Vacuum.ResponseField == "" {
+		return string(body), nil
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return string(body), fmt.Errorf("unable to decode webhook response as JSON, %s", err)
+	}
+
+	value, ok := lookupJSONPath(parsed, config.Vacuum.ResponseField)
+	if !ok {
+		return string(body), fmt.Errorf("webhook response is missing field %s", config.Vacuum.ResponseField)
+	}
+	if config.Vacuum.ResponseSuccessValue != "" && fmt.Sprint(value) != config.Vacuum.ResponseSuccessValue {
+		return string(body), fmt.Errorf("webhook response field %s is %v, expected %s",
+			config.Vacuum.ResponseField, value, config.Vacuum.ResponseSuccessValue)
+	}
+
+	return string(body), nil
+}
+
+// webhookSucceeded reports whether the response status counts as success.
+func webhookSucceeded(vacuum Vacuum, status int) bool {
+	if len(vacuum.SuccessStatusCodes) == 0 {
+		return status >= 200 && status <= 299
+	}
+	return slices.Contains(vacuum.SuccessStatusCodes, status)
+}
+
+// jsonPathStep is a single step of a JSONPath: an object key, or an array
+// index when key is unset
+type jsonPathStep struct {
+	key   string
+	index int
+	isKey bool
+}
+
+// parseJSONPath parses the subset of JSONPath selecting a single value: an
+// optional $ root followed by .key, ['key'] and [index] steps, e.g.
+// $.results[0].status. A plain dot-separated path such as hourly.time is
+// accepted as well.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	rest := strings.TrimPrefix(path, "$")
+	if rest != path {
+		rest = strings.TrimPrefix(rest, ".")
+	}
+	if rest == "" {
+		return nil, fmt.Errorf("empty JSON path %q", path)
+	}
+
+	var steps []jsonPathStep
+	for rest != "" {
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in JSON path %q", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, jsonPathStep{key: inner[1 : len(inner)-1], isKey: true})
+			} else if index, err := strconv.Atoi(inner); err == nil && index >= 0 {
+				steps = append(steps, jsonPathStep{index: index})
+			} else {
+				return nil, fmt.Errorf("invalid step [%s] in JSON path %q", inner, path)
+			}
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in JSON path %q", path)
+			}
+			steps = append(steps, jsonPathStep{key: rest[:end], isKey: true})
+			rest = rest[end:]
+		}
+		if strings.HasPrefix(rest, ".") {
+			rest = rest[1:]
+			if rest == "" {
+				return nil, fmt.Errorf("empty key in JSON path %q", path)
+			}
+		}
+	}
+	return steps, nil
+}
+
+// lookupJSONPath walks a decoded JSON document along a path parsed by
+// parseJSONPath. An invalid path is reported as missing.
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false
+	}
+	current := doc
+	for _, step := range steps {
+		if step.isKey {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if current, ok = object[step.key]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		array, ok := current.([]interface{})
+		if !ok || step.index >= len(array) {
+			return nil, false
+		}
+		current = array[step.index]
+	}
+	return current, true
+}
+
+// truncate shortens s to at most n bytes for logging.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WeekdayOverride holds settings replacing the defaults on a given weekday.
+// Unset fields keep the default.
+type WeekdayOverride struct {
+	StartThreshold        *float64
+	PastPrecipThreshold   *float64
+	FuturePrecipThreshold *float64
+}
+
+// ApplyWeekdayOverride returns the query settings with the override for the
+// given day merged over the defaults, and whether an override applied.
+func ApplyWeekdayOverride(config *Configuration, now time.Time) (Query, bool) {
+	override, ok := config.Weekdays[strings.ToLower(now.Weekday().String())]
+	if !ok {
+		return config.Query, false
+	}
+	return override.apply(config.Query), true
+}
+
+// apply returns the query settings with the override merged over them.
+func (override WeekdayOverride) apply(query Query) Query {
+	if override.StartThreshold != nil {
+		query.StartThreshold = *override.StartThreshold
+	}
+	if override.PastPrecipThreshold != nil {
+		query.PastPrecipThreshold = *override.PastPrecipThreshold
+	}
+	if override.FuturePrecipThreshold != nil {
+		query.FuturePrecipThreshold = *override.FuturePrecipThreshold
+	}
+	return query
+}
+
+// validateWeekdays checks that every override is keyed by a weekday name and
+// that an overridden start threshold is used on the day: the rules deciding
+// on the past and future thresholds only fall back to it for those left
+// unset.
+func validateWeekdays(weekdays map[string]WeekdayOverride, query Query) error {
+	for day, override := range weekdays {
+		valid := false
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(day, d.String()) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown weekday %s", day)
+		}
+		if override.StartThreshold == nil {
+			continue
+		}
+		merged := override.apply(query)
+		switch merged.StartRule {
+		case "", StartRuleBothDry, StartRuleFutureOnlyDry:
+			futureOnly := merged.StartRule == StartRuleFutureOnlyDry || merged.SkipLookback
+			if merged.FuturePrecipThreshold > 0 && (futureOnly || merged.PastPrecipThreshold > 0) {
+				return fmt.Errorf("weekdays.%s.startThreshold has no effect as the past and future precipitation thresholds are set, override those instead", day)
+			}
+		}
+	}
+	return nil
+}
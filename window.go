@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// allowedWindow is a time of day range on a set of weekdays. A range ending
+// before it starts runs past midnight into the following day.
+type allowedWindow struct {
+	days  [7]bool
+	start time.Duration
+	end   time.Duration
+}
+
+// weekdayAbbreviations maps the three-letter weekday names to their day
+var weekdayAbbreviations = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseAllowedWindow parses a window such as "Mon-Fri 10:00-16:00",
+// "Sat,Sun 09:00-12:00" or "10:00-16:00" for every day.
+func parseAllowedWindow(text string) (allowedWindow, error) {
+	var window allowedWindow
+	fields := strings.Fields(text)
+	var hours string
+	switch len(fields) {
+	case 1:
+		hours = fields[0]
+		for i := range window.days {
+			window.days[i] = true
+		}
+	case 2:
+		hours = fields[1]
+		for _, item := range strings.Split(fields[0], ",") {
+			first, last, isRange := strings.Cut(item, "-")
+			from, err := parseWeekday(first)
+			if err != nil {
+				return window, fmt.Errorf("invalid allowed window %q, %s", text, err)
+			}
+			to := from
+			if isRange {
+				if to, err = parseWeekday(last); err != nil {
+					return window, fmt.Errorf("invalid allowed window %q, %s", text, err)
+				}
+			}
+			for day := from; ; day = (day + 1) % 7 {
+				window.days[day] = true
+				if day == to {
+					break
+				}
+			}
+		}
+	default:
+		return window, fmt.Errorf("invalid allowed window %q", text)
+	}
+
+	startText, endText, ok := strings.Cut(hours, "-")
+	if !ok {
+		return window, fmt.Errorf("invalid allowed window %q, expected a time range such as 10:00-16:00", text)
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(startText); err != nil {
+		return window, fmt.Errorf("invalid allowed window %q, %s", text, err)
+	}
+	if window.end, err = parseTimeOfDay(endText); err != nil {
+		return window, fmt.Errorf("invalid allowed window %q, %s", text, err)
+	}
+	if window.start == window.end {
+		return window, fmt.Errorf("invalid allowed window %q, empty time range", text)
+	}
+	return window, nil
+}
+
+// parseWeekday parses a full or three-letter weekday name.
+func parseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(name)
+	if len(name) > 3 {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if name == strings.ToLower(day.String()) {
+				return day, nil
+			}
+		}
+	} else if day, ok := weekdayAbbreviations[name]; ok {
+		return day, nil
+	}
+	return 0, fmt.Errorf("unknown weekday %s", name)
+}
+
+// parseTimeOfDay parses an HH:MM time as the offset from midnight; 24:00
+// marks the end of the day.
+func parseTimeOfDay(text string) (time.Duration, error) {
+	if text == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	parsed, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s", text)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// contains reports whether the local time falls within the window.
+func (w allowedWindow) contains(now time.Time) bool {
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	today := now.Weekday()
+	if w.start < w.end {
+		return w.days[today] && offset >= w.start && offset < w.end
+	}
+	yesterday := (today + 6) % 7
+	return (w.days[today] && offset >= w.start) || (w.days[yesterday] && offset < w.end)
+}
+
+// InAllowedWindow reports whether the local time falls within any of
+// Schedule.AllowedWindows. Without windows every time is allowed.
+func InAllowedWindow(schedule Schedule, now time.Time) (bool, error) {
+	if len(schedule.AllowedWindows) == 0 {
+		return true, nil
+	}
+	for _, text := range schedule.AllowedWindows {
+		window, err := parseAllowedWindow(text)
+		if err != nil {
+			return false, err
+		}
+		if window.contains(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}